@@ -0,0 +1,66 @@
+package tarx
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// appleDoubleSupported is true, macOS stores AppleDouble data as extended attributes.
+const appleDoubleSupported = true
+
+// xattrNoFollow is XATTR_NOFOLLOW, the syscall package does not define it.
+const xattrNoFollow = 0x0001
+
+// mergeAppleDouble sets the content of an AppleDouble file as extended
+// attributes of a file, nothing is done if the file does not exist.
+func mergeAppleDouble(fileName string, content []byte) error {
+	attrs, err := parseAppleDouble(content)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+
+	for name, value := range attrs {
+		if err := setxattr(fileName, name, value); err != nil {
+			return &os.PathError{Op: "setxattr", Path: fileName, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// setxattr sets an extended attribute without following symlinks,
+// the syscall package does not export it on macOS.
+func setxattr(fileName, name string, value []byte) error {
+	fileNamePtr, err := syscall.BytePtrFromString(fileName)
+	if err != nil {
+		return err
+	}
+
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	var valuePtr unsafe.Pointer
+	if len(value) > 0 {
+		valuePtr = unsafe.Pointer(&value[0])
+	}
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETXATTR,
+		uintptr(unsafe.Pointer(fileNamePtr)),
+		uintptr(unsafe.Pointer(namePtr)),
+		uintptr(valuePtr),
+		uintptr(len(value)),
+		0,
+		xattrNoFollow)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !darwin
+// +build !darwin
+
+package tarx
+
+// appleDoubleSupported is false, AppleDouble files are only merged on macOS.
+const appleDoubleSupported = false
+
+// mergeAppleDouble does nothing, AppleDouble files are only merged on macOS.
+func mergeAppleDouble(fileName string, content []byte) error {
+	return nil
+}
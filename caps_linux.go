@@ -0,0 +1,31 @@
+package tarx
+
+import (
+	"syscall"
+)
+
+// capabilityXattr is the extended attribute holding the file capabilities
+const capabilityXattr = "security.capability"
+
+// getCapability returns the capabilities of a file, or nil if it has none.
+func getCapability(fileName string) ([]byte, error) {
+	size, err := syscall.Getxattr(fileName, capabilityXattr, nil)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+	if size, err = syscall.Getxattr(fileName, capabilityXattr, value); err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
+
+// setCapability sets the capabilities of a file, it requires CAP_SETFCAP.
+func setCapability(fileName string, value []byte) error {
+	return syscall.Setxattr(fileName, capabilityXattr, value, 0)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package tarx
+
+// getCapability returns nil, file capabilities are only supported on Linux.
+func getCapability(fileName string) ([]byte, error) {
+	return nil, nil
+}
+
+// setCapability fails, file capabilities are only supported on Linux.
+func setCapability(fileName string, value []byte) error {
+	return ErrCapsNotSupported
+}
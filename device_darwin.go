@@ -0,0 +1,6 @@
+package tarx
+
+// mkdev encodes a device number like the makedev macro of macOS
+func mkdev(major, minor int64) int {
+	return int(major<<24 | minor&0xffffff)
+}
@@ -0,0 +1,6 @@
+package tarx
+
+// mkdev encodes a device number like glibc's makedev
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32)
+}
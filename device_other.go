@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package tarx
+
+import "archive/tar"
+
+// mknod fails, device files are only supported on Linux and macOS.
+func mknod(fileName string, header *tar.Header) error {
+	return ErrDeviceNotSupported
+}
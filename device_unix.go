@@ -0,0 +1,31 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package tarx
+
+import (
+	"archive/tar"
+	"os"
+	"syscall"
+)
+
+// mknod creates the device file or named pipe of a header
+func mknod(fileName string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+
+	if err := syscall.Mknod(fileName, mode, mkdev(header.Devmajor, header.Devminor)); err != nil {
+		return &os.PathError{Op: "mknod", Path: fileName, Err: err}
+	}
+
+	// The permissions are masked by the umask
+	return os.Chmod(fileName, header.FileInfo().Mode().Perm())
+}
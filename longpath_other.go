@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package tarx
+
+// fixLongPath returns the path as is, only Windows limits the path length.
+func fixLongPath(fileName string) string {
+	return fileName
+}
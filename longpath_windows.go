@@ -0,0 +1,14 @@
+package tarx
+
+import (
+	"path/filepath"
+)
+
+// fixLongPath makes paths longer than MAX_PATH usable on Windows.
+func fixLongPath(fileName string) string {
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		return fileName
+	}
+	return toLongPath(absFileName)
+}
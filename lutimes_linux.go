@@ -0,0 +1,37 @@
+package tarx
+
+import (
+	"archive/tar"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Constants of utimensat missing from the syscall package
+const (
+	atFDCWD           = -0x64
+	atSymlinkNofollow = 0x100
+)
+
+// setSymlinkTimes sets the times of a symlink itself like setTimes does
+// for other files, with utimensat and AT_SYMLINK_NOFOLLOW.
+func setSymlinkTimes(fileName string, header *tar.Header, accessTime bool) error {
+	namePtr, err := syscall.BytePtrFromString(fileName)
+	if err != nil {
+		return err
+	}
+
+	times := [2]syscall.Timespec{
+		syscall.NsecToTimespec(accessTimeOf(header, accessTime).UnixNano()),
+		syscall.NsecToTimespec(header.ModTime.UnixNano()),
+	}
+
+	dir := atFDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dir), uintptr(unsafe.Pointer(namePtr)),
+		uintptr(unsafe.Pointer(&times[0])), atSymlinkNofollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "utimensat", Path: fileName, Err: errno}
+	}
+
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package tarx
+
+import "archive/tar"
+
+// setSymlinkTimes does nothing, the times of symlinks are only set on Linux.
+func setSymlinkTimes(fileName string, header *tar.Header, accessTime bool) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+package tarx
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, it allocates the blocks without changing the file size
+const fallocKeepSize = 0x01
+
+// fallocate reserves the blocks of a file before it is written,
+// tests replace it to check it is called.
+var fallocate = func(file *os.File, size int64) error {
+	// The kernel refuses to allocate zero bytes
+	if size <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+	// Some filesystems cannot allocate blocks upfront, or not with FALLOC_FL_KEEP_SIZE
+	if err == syscall.EOPNOTSUPP || err == syscall.EINVAL {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,201 @@
+package tarx
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// extractSandboxed extracts the files from a tar reader using paths
+// relative to a file descriptor of the target directory.
+func extractSandboxed(reader *tarReader, targetDir string, options *ExtractOptions) error {
+	root, err := syscall.Open(targetDir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: targetDir, Err: err}
+	}
+
+	defer syscall.Close(root)
+
+	filters := prepareFilters(options.Filters)
+
+	for {
+		err := reader.Next()
+		if err == io.EOF {
+			return reader.drain()
+		}
+		if err != nil {
+			return err
+		}
+
+		targetFileName := filepath.Clean(reader.header.Name)
+
+		// Control characters may be used to spoof names on terminals
+		if sanitized, ok := sanitizeName(targetFileName); !ok {
+			if !options.SanitizeNames {
+				return fmt.Errorf("Invalid entry name %q", reader.header.Name)
+			}
+			targetFileName = sanitized
+		}
+
+		if !optimizedMatches(targetFileName, filters) {
+			continue
+		}
+
+		// Absolute names are extracted relative to the target directory
+		names := strings.Split(strings.TrimLeft(filepath.ToSlash(targetFileName), "/"), "/")
+		if names[0] == "." || names[0] == "" {
+			continue
+		}
+
+		for _, name := range names {
+			if name == ".." {
+				return fmt.Errorf("Invalid entry name %q", reader.header.Name)
+			}
+		}
+
+		if err := extractAt(root, reader, names, options.NoOverride); err != nil {
+			return err
+		}
+	}
+}
+
+// extractAt extracts the current entry of a tar reader, `names` are the
+// components of its path relative to the `root` directory.
+func extractAt(root int, reader *tarReader, names []string, noOverride bool) error {
+	dir, err := syscall.Dup(root)
+	if err != nil {
+		return err
+	}
+
+	// The parent directories are opened one by one, failing on symlinks
+	for _, name := range names[:len(names)-1] {
+		fd, err := openDirAt(dir, name)
+		syscall.Close(dir)
+		if err != nil {
+			return err
+		}
+		dir = fd
+	}
+
+	defer syscall.Close(dir)
+
+	name := names[len(names)-1]
+	mode := uint32(reader.header.FileInfo().Mode().Perm())
+
+	switch reader.header.Typeflag {
+	case tar.TypeDir, typeGNUDumpDir:
+		fd, err := openDirAt(dir, name)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		return syscall.Fchmod(fd, mode)
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		flags := syscall.O_WRONLY | syscall.O_CREAT | syscall.O_EXCL | syscall.O_NOFOLLOW | syscall.O_CLOEXEC
+		fd := -1
+		err := replaceAt(dir, name, noOverride, func() error {
+			f, err := syscall.Openat(dir, name, flags, mode)
+			if err == nil {
+				fd = f
+			}
+			return err
+		})
+		// The file is kept if it exists and `noOverride` is set
+		if err != nil || fd < 0 {
+			return err
+		}
+		file := os.NewFile(uintptr(fd), name)
+		defer file.Close()
+		body, err := reader.openBody(nil)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		if _, err := io.Copy(file, body); err != nil {
+			return err
+		}
+		return file.Close()
+	case tar.TypeSymlink:
+		return replaceAt(dir, name, noOverride, func() error {
+			return symlinkAt(reader.header.Linkname, dir, name)
+		})
+	default:
+		return fmt.Errorf("Unhandled tar header type %d", reader.header.Typeflag)
+	}
+}
+
+// openDirAt creates a directory relative to `dir` if it does not exist
+// and opens it, symlinks are not followed.
+func openDirAt(dir int, name string) (int, error) {
+	if err := syscall.Mkdirat(dir, name, 0777); err != nil && err != syscall.EEXIST {
+		return 0, err
+	}
+
+	// O_DIRECTORY is not used because it hides whether the file is a symlink,
+	// O_NONBLOCK avoids blocking on named pipes.
+	fd, err := syscall.Openat(dir, name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err == syscall.ELOOP {
+		return 0, ErrSymlinkInPath
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		syscall.Close(fd)
+		return 0, err
+	}
+
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		syscall.Close(fd)
+		return 0, syscall.ENOTDIR
+	}
+
+	return fd, nil
+}
+
+// replaceAt calls `create`, if the file already exists it is removed
+// and `create` is called again, unless `noOverride` is set to true.
+func replaceAt(dir int, name string, noOverride bool, create func() error) error {
+	err := create()
+	if err != syscall.EEXIST {
+		return err
+	}
+
+	if noOverride {
+		return nil
+	}
+
+	if err := syscall.Unlinkat(dir, name); err != nil {
+		return err
+	}
+
+	return create()
+}
+
+// symlinkAt creates a symlink relative to `dir`, the syscall package
+// does not export symlinkat.
+func symlinkAt(target string, dir int, name string) error {
+	targetPtr, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+
+	namePtr, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(targetPtr)), uintptr(dir), uintptr(unsafe.Pointer(namePtr)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
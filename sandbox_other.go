@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package tarx
+
+// extractSandboxed fails, sandboxed extraction is only supported on Linux.
+func extractSandboxed(reader *tarReader, targetDir string, options *ExtractOptions) error {
+	return ErrSandboxNotSupported
+}
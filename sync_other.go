@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package tarx
+
+import "os"
+
+// syncDir flushes a directory to disk, so the entries created in it
+// survive a power loss.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return syncFile(file)
+}
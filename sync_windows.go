@@ -0,0 +1,7 @@
+package tarx
+
+// syncDir does nothing, directories cannot be flushed on Windows
+// and NTFS journals their entries.
+func syncDir(dir string) error {
+	return nil
+}
@@ -3,15 +3,28 @@ package tarx
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Compression is the state represents if compressed or not.
@@ -26,10 +39,144 @@ const (
 	Bzip2
 )
 
+// Format is the container format of a file detected by DetectFormat.
+type Format int
+
+const (
+	// FormatUnknown is a file that is not a known container.
+	FormatUnknown Format = iota
+	// FormatTar is an uncompressed tar file.
+	FormatTar
+	// FormatTarGzip is a gzip compressed file, assumed to be a tar file.
+	FormatTarGzip
+	// FormatTarBzip2 is a bzip2 compressed file, assumed to be a tar file.
+	FormatTarBzip2
+	// FormatZip is a zip file, only ReadFile reads zip files.
+	FormatZip
+)
+
+// TextConvert is the conversion of line endings applied to text files
+// on extraction.
+type TextConvert int
+
+const (
+	// TextConvertOff keeps the line endings as they are.
+	TextConvertOff TextConvert = iota
+	// TextConvertToLF converts CRLF line endings to LF.
+	TextConvertToLF
+	// TextConvertToCRLF converts LF line endings to CRLF.
+	TextConvertToCRLF
+)
+
+// SymlinkMode is how symlinks are extracted
+type SymlinkMode int
+
+const (
+	// SymlinkLink extracts symlinks as symlinks.
+	SymlinkLink SymlinkMode = iota
+	// SymlinkCopy extracts symlinks as copies of the regular files of
+	// the tar file they point to, for systems where creating symlinks
+	// requires privileges like Windows.
+	SymlinkCopy
+	// SymlinkSkip does not extract symlinks.
+	SymlinkSkip
+)
+
+// DefaultReadBufferSize is the default size of the buffer used to read
+// compressed tar files.
+const DefaultReadBufferSize = 64 * 1024
+
+// adaptiveSampleSize is how many bytes of a file are sampled to decide
+// whether it is worth compressing.
+const adaptiveSampleSize = 8 * 1024
+
+// incompressibleEntropy is the entropy in bits per byte above which
+// a file is considered incompressible.
+const incompressibleEntropy = 7.5
+
+// indexExtension is appended to the name of a tar file to name its index
+const indexExtension = ".idx"
+
+// ChecksumEntryName is the name of the entry written by AppendChecksum
+const ChecksumEntryName = ".tarx-sha256"
+
+// blockSize is the size of the blocks of a tar file, headers take one
+// block and bodies are padded to a multiple of it.
+const blockSize = 512
+
+// textSampleSize is how many bytes of a file are sniffed for NUL bytes
+// to decide whether it is a text file.
+const textSampleSize = 8 * 1024
+
+// concurrentEntrySize is the size of the largest entries read into memory
+// to be written by the workers of Concurrency, it bounds the memory used.
+const concurrentEntrySize = 1024 * 1024
+
+// paxCapability is the PAX record holding the file capabilities,
+// the same used by GNU tar and bsdtar.
+const paxCapability = "SCHILY.xattr.security.capability"
+
+// paxDedup is the PAX record holding the name of the entry with the
+// same content as a deduplicated entry.
+const paxDedup = "TARX.dedup"
+
+// paxCompression is the PAX record holding the compression of the body
+// of an entry, and paxSize the size of the body once decompressed.
+const (
+	paxCompression = "TARX.compression"
+	paxSize        = "TARX.size"
+)
+
+// openFile opens a file to be written into a tar file,
+// tests replace it to simulate slow storage.
+var openFile = func(fileName string) (io.ReadCloser, error) {
+	return os.Open(fileName)
+}
+
+// walk walks the source path of Compress, tests replace it to see
+// which files are walked.
+var walk = filepath.Walk
+
+// syncFile flushes a file to disk, tests replace it to check it is called.
+var syncFile = func(file *os.File) error {
+	return file.Sync()
+}
+
+// typeGNUDumpDir is the GNU incremental directory entry ('D'),
+// archive/tar does not define it.
+const typeGNUDumpDir byte = 'D'
+
+// Collision is the policy applied when an entry name is duplicated.
+type Collision int
+
+const (
+	// CollisionKeepFirst keeps the first entry and skips the duplicates.
+	CollisionKeepFirst Collision = iota
+	// CollisionError fails with ErrDuplicateEntry.
+	CollisionError
+)
+
 // Common errors
 var (
-	ErrAppendNotSupported = errors.New("Append is only supported on compressed files")
-	ErrBzip2NotSupported  = errors.New("Bzip2 is not supported for compression")
+	ErrAppendNotSupported   = errors.New("Append is only supported on compressed files")
+	ErrBzip2NotSupported    = errors.New("Bzip2 is not supported for compression")
+	ErrDuplicateEntry       = errors.New("Duplicate entry name")
+	ErrIndexNotSupported    = errors.New("Index is only supported on uncompressed files")
+	ErrPerEntryNotSupported = errors.New("Per entry compression is only supported on uncompressed files")
+	ErrReaderClosed         = errors.New("Reader is closed")
+	ErrEntryTimeout         = errors.New("Timeout reading entry")
+	ErrCapsNotSupported     = errors.New("File capabilities are only supported on Linux")
+	ErrChecksumNotFound     = errors.New("Checksum entry not found")
+	ErrChecksumMismatch     = errors.New("Checksum mismatch")
+	ErrSizeLimitExceeded    = errors.New("Size limit exceeded")
+	ErrDepthLimitExceeded   = errors.New("Depth limit exceeded")
+	ErrDeviceNotSupported   = errors.New("Device files are only supported on Linux and macOS")
+	ErrSymlinkInPath        = errors.New("Path goes through a symlink")
+	ErrPathTraversal        = errors.New("Path goes outside the target directory")
+	ErrNoTopLevelDir        = errors.New("Entries are not under a single top level directory")
+	ErrSandboxNotSupported  = errors.New("Sandboxed extraction is only supported on Linux")
+	ErrCheckpointCompressed = errors.New("Checkpoint is only supported on uncompressed files")
+	ErrResumeWithoutAppend  = errors.New("Resuming from a checkpoint requires Append")
 )
 
 // CompressOptions is the compression configuration
@@ -38,6 +185,124 @@ type CompressOptions struct {
 	Compression      Compression
 	IncludeSourceDir bool
 	Filters          []string
+
+	// Incremental writes directories as GNU incremental entries (type 'D')
+	// and skips files not modified after SnapshotTime.
+	Incremental  bool
+	SnapshotTime time.Time
+
+	// RewriteSymlinks rewrites the targets of symlinks pointing inside
+	// the source path to be relative to the symlink, so they remain valid
+	// wherever the tar file is extracted.
+	// Targets outside the source path are left alone.
+	RewriteSymlinks bool
+
+	// Collision is the policy for duplicated entries while merging tar files
+	Collision Collision
+
+	// AdaptiveCompression stores files that look incompressible without
+	// compression to save CPU, it is only used with Gzip.
+	// Each switch starts a new gzip member, which gzip readers handle
+	// transparently.
+	AdaptiveCompression bool
+
+	// EntryTimeout aborts with ErrEntryTimeout when reading a single file
+	// takes longer than this, zero means no timeout.
+	EntryTimeout time.Duration
+
+	// PreserveCaps stores the Linux file capabilities of regular files
+	PreserveCaps bool
+
+	// AppendChecksum writes a last entry named `.tarx-sha256` holding the
+	// hex SHA-256 of the bodies of all previous entries, see Verify.
+	AppendChecksum bool
+
+	// FollowSymlinks archives what symlinks point to instead of the
+	// symlinks themselves, symlinked directories are walked as well.
+	// A directory is not walked again inside itself to avoid cycles.
+	// By default symlinks are archived as symlinks and never walked.
+	FollowSymlinks bool
+
+	// Dedup stores the files with the same content as a previous file
+	// as an empty entry referencing it, the functions of this package
+	// read the content of the previous file for it.
+	// Other tools extract such entries as empty files.
+	Dedup bool
+
+	// Checkpoint is the path of a file recording the entries written so
+	// far. If Compress fails the tar file is kept with the entries written
+	// before the failure, and calling Compress again with Append skips
+	// the entries recorded. If the process was killed the entry it was
+	// writing is dropped. The file is removed once Compress succeeds.
+	// Only uncompressed tar files can be resumed.
+	Checkpoint string
+
+	// Format is the tar format of the entries, like tar.FormatUSTAR for
+	// old readers. Entries the format cannot hold fail to be written,
+	// times are truncated to seconds for formats other than PAX.
+	// tar.FormatPAX records the mtime, atime and ctime of the files with
+	// nanoseconds in the `mtime`, `atime` and `ctime` records, atime and
+	// ctime are only known on Unix.
+	// By default the format is chosen for each entry by archive/tar,
+	// which rounds mtimes to seconds and leaves out atimes and ctimes.
+	Format tar.Format
+
+	// BaseManifest is the path of the manifest of a previous tar file,
+	// regular files with the same size and either the same mtime or the
+	// same SHA-256 are left out. Directories and symlinks are always written.
+	BaseManifest string
+
+	// WriteManifest is the path where the manifest of all regular files
+	// walked is written, including the ones left out by BaseManifest.
+	// Files of the base manifest no longer found are listed as deleted.
+	WriteManifest string
+
+	// WriteIndex writes the index of the entries next to the tar file,
+	// named after it with the `.idx` extension, so OpenWithIndex can read
+	// an entry directly. It is only supported on uncompressed files,
+	// and not by CompressVolumes.
+	WriteIndex bool
+
+	// GitignoreAware leaves out the files ignored by the .gitignore files
+	// found under the source path, and the .git directories. Negations,
+	// directory-only, anchored and `**` patterns are supported.
+	GitignoreAware bool
+
+	// SkipEmptyDirs leaves out the directories without any entry written
+	// under them, like the ones whose files were all filtered out.
+	// Directories of incremental archives are always written.
+	SkipEmptyDirs bool
+
+	// PerEntryCompression gzips the body of each regular file on its own
+	// while the tar file itself is left uncompressed, so an entry can be
+	// read without decompressing the others, see OpenWithIndex.
+	// The size of such entries is the compressed size. Extract and Find
+	// decompress them, other tools extract them as gzip files.
+	PerEntryCompression bool
+
+	// Sync flushes the tar file and its directory to disk before the tar
+	// file is closed, so it survives a power loss once Compress returns.
+	Sync bool
+
+	// EmitRootEntry writes a `./` entry for the source directory when
+	// IncludeSourceDir is false, like GNU tar does, extracting it applies
+	// the mode of the source directory to the target directory.
+	EmitRootEntry bool
+
+	// SkipMissing leaves out the files of the list given to
+	// CompressFileList which do not exist instead of failing.
+	SkipMissing bool
+
+	// RetryFunc is called when reading a file fails, with the number of
+	// failures of the file so far. If it returns true the file is opened
+	// again and read from where it failed, as the part of the entry
+	// written already cannot be taken back.
+	RetryFunc func(fileName string, attempt int, err error) bool
+
+	// UnusedFilterFunc is called once Compress succeeds with each filter
+	// which matched no file, like a mistyped one. The files under the
+	// directories left out by the filters are not looked at.
+	UnusedFilterFunc func(filter string)
 }
 
 // ExtractOptions is the decompression configuration
@@ -45,16 +310,261 @@ type ExtractOptions struct {
 	FlatDir    bool
 	Filters    []string
 	NoOverride bool
+
+	// SubtreePrefix extracts only the entries under this directory
+	// as if it were the root of the tar file.
+	SubtreePrefix string
+
+	// ReadBufferSize is the size of the buffer used to read compressed
+	// tar files, if zero DefaultReadBufferSize is used.
+	ReadBufferSize int
+
+	// VerifyManifest is the path of a JSON manifest, each extracted file
+	// must match the SHA-256 recorded in it.
+	VerifyManifest string
+
+	// RenameFunc returns the name of an entry on disk relative to the
+	// target directory, the entry is skipped if it returns false.
+	// It is called after all other options changed the name.
+	RenameFunc func(name string) (string, bool)
+
+	// PreserveTimes sets the mtime of the extracted files and directories
+	// to the one stored in the tar file.
+	PreserveTimes bool
+
+	// PreserveAccessTime sets the atime stored in the tar file as well,
+	// falling back to the mtime when there is none. It implies PreserveTimes.
+	PreserveAccessTime bool
+
+	// SanitizeNames replaces NUL and control characters in entry names
+	// with '_', otherwise such names fail the extraction.
+	SanitizeNames bool
+
+	// PreserveCaps restores the Linux file capabilities stored in the
+	// tar file, it requires CAP_SETFCAP.
+	PreserveCaps bool
+
+	// FollowSymlinks allows extracting through symlinks found on disk
+	// under the target directory. By default an entry whose parent path
+	// goes through a symlink fails with ErrSymlinkInPath, because the
+	// symlink could point outside the target directory.
+	FollowSymlinks bool
+
+	// DefaultFileMode and DefaultDirMode are the permissions given to
+	// files and directories stored without any permission bits, like
+	// the ones converted from zip files created on Windows.
+	DefaultFileMode os.FileMode
+	DefaultDirMode  os.FileMode
+
+	// WriterFor is called for each entry to be extracted, if it returns
+	// true the content of the entry is copied to the returned writer
+	// instead of being written to disk.
+	WriterFor func(header *tar.Header) (io.Writer, bool)
+
+	// LastWins extracts only the last occurrence of the entries stored
+	// more than once, even with NoOverride. The tar file is read twice,
+	// so ExtractStream ignores it.
+	LastWins bool
+
+	// ReadOnly removes the write permissions of the extracted files.
+	ReadOnly bool
+
+	// TypeFilter is the list of typeflags to be extracted, like
+	// tar.TypeReg and tar.TypeDir, if empty all types are extracted.
+	TypeFilter []byte
+
+	// TextConvert converts the line endings of the extracted text files,
+	// files with NUL bytes in their first 8KB are considered binary
+	// and are left as they are.
+	TextConvert TextConvert
+
+	// PreserveOwner sets the uid and gid stored in the tar file on the
+	// extracted entries, it usually requires root and fails on Windows.
+	PreserveOwner bool
+
+	// UIDMap and GIDMap remap the stored uids and gids to the ones of
+	// this host when PreserveOwner is set, ids missing are kept.
+	UIDMap map[int]int
+	GIDMap map[int]int
+
+	// MergeAppleDouble applies the `._name` AppleDouble entries to the
+	// `name` entries as extended attributes instead of extracting them,
+	// it is only supported on macOS and ignored on other platforms.
+	MergeAppleDouble bool
+
+	// MaxTotalSize fails the extraction with ErrSizeLimitExceeded as
+	// soon as the files extracted add up to more than this many bytes.
+	MaxTotalSize int64
+
+	// Progress is called by Extract as the tar file is read, with the
+	// bytes read so far and the size of the file. For compressed files
+	// these are compressed bytes, so the total is known upfront.
+	Progress func(read, total int64)
+
+	// StripTopLevel extracts the entries of the single directory all
+	// entries are under, like `pkg-1.2.3/`, without it. If there is no
+	// such directory ErrNoTopLevelDir is returned. SubtreePrefix is
+	// relative to it. The tar file is read twice, so ExtractStream ignores it.
+	StripTopLevel bool
+
+	// MaxDepth fails the extraction with ErrDepthLimitExceeded on the
+	// first entry whose path has more than this many components,
+	// `c/c1.txt` has two. It applies to the names written to disk.
+	MaxDepth int
+
+	// PreserveDevices creates the character and block devices and the
+	// named pipes stored in the tar file with their device numbers,
+	// devices usually require root. By default such entries fail the
+	// extraction. It is only supported on Linux and macOS.
+	PreserveDevices bool
+
+	// SymlinkMode is how symlinks are extracted, with SymlinkCopy the
+	// copies are written once all entries are extracted and a symlink
+	// pointing to anything but a regular file extracted fails.
+	SymlinkMode SymlinkMode
+
+	// SkeletonOnly creates the regular files empty, without reading their
+	// content, along with the directories and symlinks, to preview the
+	// layout of a tar file. Modes and times are applied as usual while
+	// VerifyManifest is ignored.
+	SkeletonOnly bool
+
+	// PreAllocate allocates the blocks of each regular file for its size
+	// before writing it, which reduces fragmentation. The size of the file
+	// is not changed. It is only supported on Linux and ignored by the
+	// filesystems which cannot allocate blocks upfront.
+	PreAllocate bool
+
+	// UnusedFilterFunc is called once Extract succeeds with each filter
+	// which matched no entry, like a mistyped one. The entries under the
+	// directories left out by the filters are not looked at.
+	UnusedFilterFunc func(filter string)
+
+	// Concurrency is the number of regular files written at the same time,
+	// the contents of the files up to 1 MiB are read into memory as the tar
+	// file is read one entry after the other, larger files are written as
+	// they are read. The other entries are extracted once the files being
+	// written are done, in the order of the tar file.
+	Concurrency int
+}
+
+// Manifest records the checksums of the files of a tar file,
+// it is stored as JSON.
+type Manifest struct {
+	Files map[string]ManifestEntry `json:"files"`
+	// Deleted are the files of the base manifest missing when
+	// the manifest was written by Compress.
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// ManifestEntry is the checksum of a single file of the manifest
+type ManifestEntry struct {
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// EntrySpec is an entry to be written as is by WriteEntries,
+// Body is nil for entries without content like directories and symlinks.
+type EntrySpec struct {
+	Header *tar.Header
+	Body   io.Reader
+}
+
+// Entry describes an entry of a tar file
+type Entry struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Item is an entry of a tar file read by ReadAll, Data is nil
+// for entries other than regular files.
+type Item struct {
+	Header *tar.Header
+	Data   []byte
+}
+
+// Reader reads the entries of a tar file one after the other.
+// The content of entries written with PerEntryCompression is decompressed,
+// deduplicated entries have the content of the entry they reference,
+// except for the tar files of OpenAt and OpenSplit which cannot be read again.
+type Reader struct {
+	reader *tarReader
+	// body is the content of the current entry, err is returned instead
+	// if it could not be opened
+	body io.ReadCloser
+	err  error
+	// files are the volumes opened by OpenSplit
+	files []*os.File
+	// next are the tar files to be read by Concat after the current one
+	next []string
+}
+
+// IndexEntry is the location of an entry body within an uncompressed tar file
+type IndexEntry struct {
+	Name   string
+	Offset int64
+	Size   int64
+	// Compressed is set for the entries written with PerEntryCompression
+	Compressed bool
+	// Dedup is the name of the entry a deduplicated entry references
+	Dedup string `json:",omitempty"`
+}
+
+// CorruptError is returned by Verify and ValidateStructure when a tar
+// file cannot be read.
+type CorruptError struct {
+	// Offset is the position in the file where reading failed, for
+	// compressed files it is approximate because reads are buffered.
+	Offset int64
+	// LastEntry is the name of the last entry read, empty if none was.
+	LastEntry string
+	Err       error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("Corrupt tar file at offset %d after entry %q: %v", e.Offset, e.LastEntry, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+// DiffResult holds the differences between a tar file and a directory
+type DiffResult struct {
+	// Missing are the entries of the tar file missing in the directory
+	Missing []string
+	// Extra are the files of the directory missing in the tar file
+	Extra []string
+	// Changed are the entries whose type, size, mode or mtime differ
+	Changed []string
 }
 
 // Internal struct to hold all resources to read a tar file
 type tarReader struct {
 	io.ReadCloser
-	file           *os.File
-	fileName       string
-	reader         *tar.Reader
-	compressReader io.ReadCloser
-	header         *tar.Header
+	file            *os.File
+	fileName        string
+	reader          *tar.Reader
+	compressReader  io.ReadCloser
+	header          *tar.Header
+	closed          bool
+	digest          hash.Hash
+	sum             []byte
+	extracted       bool
+	textConvert     TextConvert
+	dedupSource     string
+	progress        *progressReader
+	preserveDevices bool
+	skeletonOnly    bool
+	preAllocate     bool
+	// body is the content of the entry read upfront, see buffered
+	body      io.Reader
+	sizeLimit *sizeLimit
 }
 
 // Internal struct to hold all resources to write a tar file
@@ -64,11 +574,43 @@ type tarWriter struct {
 	fileName       string
 	writer         *tar.Writer
 	compressWriter io.WriteCloser
+	linkRoot       string
+	proxy          *writerProxy
+	level          int
+	entryTimeout   time.Duration
+	preserveCaps   bool
+	checksum       hash.Hash
+	followSymlinks bool
+	append         bool
+	dedup          map[string]string
+	format         tar.Format
+	index          []IndexEntry
+	perEntry       bool
+	sync           bool
+	retry          func(fileName string, attempt int, err error) bool
+	// output is the file or the volumes the tar file is written into
+	output  io.Writer
+	volumes *volumeWriter
+}
+
+// A directory walked by Compress not written yet
+type pendingDir struct {
+	filePath    string
+	relFilePath string
 }
 
 // Compress compress a source path into a tar file.
 // All files will be relative to the tar file.
+// The entries of each directory are written sorted by name, each directory
+// entry right before its children, so the output is stable and parents
+// are always extracted before their children.
 func Compress(fileName, srcPath string, options *CompressOptions) error {
+	return compress(fileName, srcPath, options, nil)
+}
+
+// compress is Compress, if `volumes` is not nil the tar file is written
+// into its volumes.
+func compress(fileName, srcPath string, options *CompressOptions, volumes *volumeWriter) error {
 	if options == nil {
 		options = &CompressOptions{}
 	}
@@ -78,7 +620,25 @@ func Compress(fileName, srcPath string, options *CompressOptions) error {
 		return err
 	}
 
-	writer, err := newWriter(fileName, options)
+	var checkpoint *checkpoint
+	if options.Checkpoint != "" {
+		// A compressed stream cut off cannot be appended to
+		if options.Compression != Uncompressed {
+			return ErrCheckpointCompressed
+		}
+		if checkpoint, err = openCheckpoint(options.Checkpoint); err != nil {
+			return err
+		}
+		defer checkpoint.Close()
+
+		// Otherwise the tar file would be truncated and the entries
+		// recorded skipped
+		if len(checkpoint.done) > 0 && !options.Append {
+			return ErrResumeWithoutAppend
+		}
+	}
+
+	writer, err := openWriter(fileName, options, volumes)
 	if err != nil {
 		return err
 	}
@@ -86,6 +646,15 @@ func Compress(fileName, srcPath string, options *CompressOptions) error {
 	// Removes the last slash to avoid different behaviors when `srcPath` is a folder
 	srcPath = path.Clean(srcPath)
 
+	// The source directory entry is named after the last element of
+	// `srcPath`, for paths like `.` or `..` we need the real name.
+	if options.IncludeSourceDir && (path.Base(srcPath) == "." || path.Base(srcPath) == "..") {
+		if srcPath, err = filepath.Abs(srcPath); err != nil {
+			writer.Close(true)
+			return err
+		}
+	}
+
 	// All files added are relative to the tar file
 	// If IncludeSourceDir is true one level behind is added
 	relPath := path.Dir(srcPath)
@@ -96,431 +665,3160 @@ func Compress(fileName, srcPath string, options *CompressOptions) error {
 	// To improve performance filters are prepared before.
 	filters := prepareFilters(options.Filters)
 
-	err = filepath.Walk(srcPath,
-		func(filePath string, info os.FileInfo, err error) error {
-			if err != nil {
+	var usedFilters []bool
+	if options.UnusedFilterFunc != nil {
+		usedFilters = make([]bool, len(filters))
+	}
+
+	var base, manifest *Manifest
+	if options.BaseManifest != "" {
+		if base, err = readManifest(options.BaseManifest); err != nil {
+			writer.Close(true)
+			return err
+		}
+	}
+	if options.WriteManifest != "" {
+		manifest = &Manifest{Files: map[string]ManifestEntry{}}
+	}
+
+	// Symlinks are rewritten relative to the tree being compressed
+	if options.RewriteSymlinks {
+		linkRoot := srcPath
+		if !srcInfo.IsDir() {
+			linkRoot = path.Dir(srcPath)
+		}
+		if writer.linkRoot, err = filepath.Abs(linkRoot); err != nil {
+			writer.Close(true)
+			return err
+		}
+	}
+
+	var ignore *gitignore
+	if options.GitignoreAware {
+		ignore = &gitignore{}
+	}
+
+	// Directories are only written once an entry under them is written
+	var pendingDirs []pendingDir
+
+	walkFn := func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if ignore != nil {
+			skip, err := ignore.walk(srcPath, filePath, info)
+			if err != nil || skip {
 				return err
 			}
+		}
 
-			// Makes the file to be relative to the tar file
-			// We don't support absolute path while compressing
-			// but it can be done further
-			relFilePath, err := filepath.Rel(relPath, filePath)
-			if err != nil {
+		// Makes the file to be relative to the tar file
+		// We don't support absolute path while compressing
+		// but it can be done further
+		relFilePath, err := filepath.Rel(relPath, filePath)
+		if err != nil {
+			return err
+		}
+
+		// When IncludeSourceDir is false the relative path for the
+		// root folder is '.', we have to ignore this folder
+		if relFilePath == "." {
+			if !options.EmitRootEntry || (checkpoint != nil && checkpoint.done["./"]) {
+				return nil
+			}
+			if err := writer.Write(filePath, "./"); err != nil {
 				return err
 			}
+			return checkpoint.add("./")
+		}
+
+		if usedFilters != nil {
+			markFilters(relFilePath, filters, usedFilters)
+		}
+
+		// Check if we have to add the current file based on the user filters,
+		// nothing under a directory not matching can match
+		if !optimizedMatches(relFilePath, filters) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-			// When IncludeSourceDir is false the relative path for the
-			// root folder is '.', we have to ignore this folder
-			if relFilePath == "." {
+		// Entries written before an interruption are not written again
+		if checkpoint != nil && checkpoint.done[relFilePath] {
+			return nil
+		}
+
+		if info.Mode().IsRegular() && (base != nil || manifest != nil) {
+			name := filepath.ToSlash(relFilePath)
+			entry := ManifestEntry{Size: info.Size(), ModTime: info.ModTime()}
+			unchanged := false
+			if base != nil {
+				if unchanged, err = base.unchanged(filePath, name, &entry); err != nil {
+					return err
+				}
+			}
+			// The digest is only read here when the base manifest did not need it
+			if manifest != nil {
+				if entry.SHA256 == "" {
+					if entry.SHA256, err = fileChecksum(filePath); err != nil {
+						return err
+					}
+				}
+				manifest.Files[name] = entry
+			}
+			if unchanged {
 				return nil
 			}
+		}
 
-			// Check if we have to add the current file based on the user filters
-			if !optimizedMatches(relFilePath, filters) {
+		// Incremental archives carry a listing of each directory
+		// and only the files changed since the last snapshot
+		if options.Incremental {
+			if info.IsDir() {
+				content, err := dumpDir(filePath, options.SnapshotTime)
+				if err != nil {
+					return err
+				}
+				if err := writer.WriteDumpDir(filePath, relFilePath, content); err != nil {
+					return err
+				}
+				return checkpoint.add(relFilePath)
+			}
+			if !info.ModTime().After(options.SnapshotTime) {
 				return nil
 			}
+		}
 
-			// All good, relative path made, filters applied, now we can write
-			// the user file into tar file
-			return writer.Write(filePath, relFilePath)
-		})
+		if options.SkipEmptyDirs {
+			// The directories left are the ones not holding this entry,
+			// which are empty as they were walked before
+			for len(pendingDirs) > 0 && !isWithin(pendingDirs[len(pendingDirs)-1].relFilePath, relFilePath) {
+				pendingDirs = pendingDirs[:len(pendingDirs)-1]
+			}
+			if info.IsDir() {
+				pendingDirs = append(pendingDirs, pendingDir{filePath, relFilePath})
+				return nil
+			}
+			for _, dir := range pendingDirs {
+				if err := writer.Write(dir.filePath, dir.relFilePath); err != nil {
+					return err
+				}
+				if err := checkpoint.add(dir.relFilePath); err != nil {
+					return err
+				}
+			}
+			pendingDirs = pendingDirs[:0]
+		}
 
-	// If any error occurs we delete the tar file
-	writer.Close(err != nil)
+		// All good, relative path made, filters applied, now we can write
+		// the user file into tar file
+		if err := writer.Write(filePath, relFilePath); err != nil {
+			return err
+		}
+		return checkpoint.add(relFilePath)
+	}
 
-	return err
-}
+	if options.FollowSymlinks {
+		err = walkFollow(srcPath, walkFn)
+	} else {
+		err = walk(srcPath, walkFn)
+	}
 
-// Extract extracts the files from a tar file into a target directory.
-func Extract(fileName, targetDir string, options *ExtractOptions) error {
-	if options == nil {
-		options = &ExtractOptions{}
+	if err == nil && manifest != nil {
+		err = manifest.write(options.WriteManifest, base)
 	}
 
-	reader, err := newReader(fileName)
-	if err != nil {
+	if err == nil && usedFilters != nil {
+		reportUnusedFilters(options.Filters, usedFilters, options.UnusedFilterFunc)
+	}
+
+	// If any error occurs we delete the tar file,
+	// unless it is going to be resumed from the checkpoint
+	if checkpoint == nil {
+		writer.Close(err != nil)
 		return err
 	}
 
-	defer reader.Close()
+	// The checksum is written once the tar file is complete
+	if err != nil {
+		writer.checksum = nil
+	}
 
-	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
-		return err
+	if closeErr := writer.Close(false); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = checkpoint.Remove()
 	}
 
-	// To improve performance the filters are prepared before.
-	filters := prepareFilters(options.Filters)
+	return err
+}
 
-	for {
-		err := reader.Next()
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			return err
-		}
+// CompressFileList writes the files and directories listed in a file,
+// one path per line, into a tar file like `tar -T`. Directories are not
+// walked. The entries are named relative to the deepest directory
+// holding all paths listed.
+func CompressFileList(fileName, listName string, options *CompressOptions) error {
+	if options == nil {
+		options = &CompressOptions{}
+	}
 
-		// Removes the last slash to avoid different behaviors when `header.Name` is a folder
-		targetFileName := filepath.Clean(reader.header.Name)
+	content, err := ioutil.ReadFile(listName)
+	if err != nil {
+		return err
+	}
 
-		// Check if we have to extact the current file based on the user filters
-		if !optimizedMatches(targetFileName, filters) {
+	filePaths := []string{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
 			continue
 		}
 
-		// If FlatDir is true we have to extract all files into root folder
-		// and we have to ignore all sub directories
-		if options.FlatDir {
-			if reader.header.Typeflag == tar.TypeDir {
+		if _, err := os.Lstat(line); err != nil {
+			if os.IsNotExist(err) && options.SkipMissing {
 				continue
 			}
-			targetFileName = filepath.Base(targetFileName)
+			return err
 		}
 
-		// If `targetFileName` is an absolute path we are going to extract it
-		// relative to the `targetDir`
-		targetFileName = path.Join(targetDir, targetFileName)
-
-		if err := reader.Extract(targetFileName, options.NoOverride); err != nil {
+		filePath, err := filepath.Abs(line)
+		if err != nil {
 			return err
 		}
+		filePaths = append(filePaths, filePath)
 	}
-}
-
-// Find returns the header and ReadCloser for the entry in the tarfile
-// that matches the filename. If nothing matches, an `os.ErrNotExists`
-// error is returned.
-// If the `targetFileName` is not a regular file it returns a reader `nil`.
-func Find(fileName, targetFileName string) (*tar.Header, io.ReadCloser, error) {
-	reader, err := newReader(fileName)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	targetFileName = path.Clean(targetFileName)
 
-	for {
-		header, err := reader.reader.Next()
-		if err == io.EOF {
-			reader.Close()
-			return nil, nil, os.ErrNotExist
-		}
-		if err != nil {
-			reader.Close()
-			return nil, nil, err
+	baseDir := ""
+	for _, filePath := range filePaths {
+		if baseDir == "" {
+			baseDir = filepath.Dir(filePath)
 		}
-
-		// If the file found is not a regular file we don't return a reader
-		if targetFileName == path.Clean(header.Name) {
-			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
-				return header, reader, nil
-			}
-			reader.Close()
-			return header, nil, nil
+		for !isWithin(baseDir, filePath) {
+			baseDir = filepath.Dir(baseDir)
 		}
 	}
-}
 
-// List lists all entries from a tar file.
-func List(fileName string) ([]*tar.Header, error) {
-	reader, err := newReader(fileName)
+	writer, err := newWriter(fileName, options)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer reader.Close()
-
-	headers := []*tar.Header{}
-
-	for {
-		err := reader.Next()
-		if err == io.EOF {
-			return headers, nil
+	for _, filePath := range filePaths {
+		name, err := filepath.Rel(baseDir, filePath)
+		if err == nil {
+			err = writer.Write(filePath, name)
 		}
 		if err != nil {
-			return nil, err
+			writer.Close(true)
+			return err
 		}
-
-		headers = append(headers, reader.header)
 	}
+
+	return writer.Close(false)
 }
 
-// newReader opens a tar file as readonly
-func newReader(fileName string) (*tarReader, error) {
-	file, err := os.OpenFile(fileName, os.O_RDONLY, os.ModePerm)
-	if err != nil {
-		return nil, err
+// CompressVolumes compresses a source path into volumes of at most
+// `maxBytes` bytes, named like Split does, and returns their names.
+// A new volume is started when the next entry does not fit in the current
+// one, entries larger than a volume and compressed tar files are split
+// anywhere. Append and Checkpoint are not supported.
+func CompressVolumes(fileName, srcPath string, maxBytes int64, options *CompressOptions) ([]string, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("Invalid volume size %d", maxBytes)
 	}
 
-	// Reads the header from the file to see which compression
-	// this file has been using.
-	compression, err := detectCompression(file)
-	if err != nil {
-		return nil, err
+	if options == nil {
+		options = &CompressOptions{}
 	}
 
-	var compressReader io.ReadCloser
+	if options.Append {
+		return nil, errors.New("Append is not supported with volumes")
+	}
 
-	switch compression {
-	case Gzip:
-		if compressReader, err = gzip.NewReader(file); err != nil {
-			file.Close()
-			return nil, err
-		}
-	case Bzip2:
-		compressReader = &readCloserWrapper{Reader: bzip2.NewReader(file)}
+	if options.Checkpoint != "" {
+		return nil, errors.New("Checkpoint is not supported with volumes")
 	}
 
-	var reader *tar.Reader
+	// The offsets of an index would not match the volumes
+	if options.WriteIndex {
+		return nil, errors.New("WriteIndex is not supported with volumes")
+	}
 
-	if compressReader == nil {
-		reader = tar.NewReader(file)
-	} else {
-		reader = tar.NewReader(compressReader)
+	volumes := &volumeWriter{fileName: fileName, maxBytes: maxBytes, sync: options.Sync}
+	if err := compress(fileName, srcPath, options, volumes); err != nil {
+		return nil, err
 	}
 
-	return &tarReader{
-		file:           file,
-		fileName:       fileName,
-		reader:         reader,
+	return volumes.names, nil
+}
+
+// CompressGzip compresses a source path into a gzip compressed tar file
+// with the default options.
+func CompressGzip(fileName, srcPath string) error {
+	return Compress(fileName, srcPath, &CompressOptions{Compression: Gzip})
+}
+
+// CompressBlob writes a tar file with a single regular file named
+// `entryName` holding `data`.
+func CompressBlob(fileName, entryName string, data []byte, options *CompressOptions) error {
+	if options == nil {
+		options = &CompressOptions{}
+	}
+
+	writer, err := newWriter(fileName, options)
+	if err != nil {
+		return err
+	}
+
+	err = writer.WriteBytes(entryName, data)
+
+	// If any error occurs we delete the tar file
+	writer.Close(err != nil)
+
+	return err
+}
+
+// WriteEntries writes a tar file with the given headers and bodies,
+// no metadata is taken from the file system.
+// The size of each body must match the size in its header.
+func WriteEntries(fileName string, entries []EntrySpec, options *CompressOptions) error {
+	if options == nil {
+		options = &CompressOptions{}
+	}
+
+	writer, err := newWriter(fileName, options)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err = writer.WriteEntry(entry); err != nil {
+			break
+		}
+	}
+
+	// If any error occurs we delete the tar file
+	writer.Close(err != nil)
+
+	return err
+}
+
+// Extract extracts the files from a tar file into a target directory.
+func Extract(fileName, targetDir string, options *ExtractOptions) (err error) {
+	if options == nil {
+		options = &ExtractOptions{}
+	}
+
+	reader, err := newProgressReader(fileName, options.ReadBufferSize, options.Progress)
+	if err != nil {
+		return err
+	}
+
+	defer reader.closeWithError(&err)
+
+	if options.StripTopLevel {
+		topLevelDir, err := topLevelDir(fileName)
+		if err != nil {
+			return err
+		}
+		stripped := *options
+		stripped.SubtreePrefix = path.Join(topLevelDir, options.SubtreePrefix)
+		options = &stripped
+	}
+
+	var occurrences map[string]int
+	if options.LastWins {
+		if occurrences, err = countOccurrences(fileName); err != nil {
+			return err
+		}
+	}
+
+	return extract(reader, targetDir, options, occurrences, nil)
+}
+
+// ExtractGzip extracts the files from a gzip compressed tar file into a
+// target directory with the default options, which refuse entries going
+// outside the target directory.
+func ExtractGzip(fileName, targetDir string) error {
+	return Extract(fileName, targetDir, nil)
+}
+
+// ExtractSandboxed extracts the files from a tar file into a target
+// directory, every path is resolved relative to the target directory
+// without following symlinks, so no entry can escape it even if the
+// directory is changed during the extraction.
+// Only the Filters, NoOverride, ReadBufferSize and SanitizeNames options
+// are supported, setting any other one fails.
+func ExtractSandboxed(fileName, targetDir string, options *ExtractOptions) (err error) {
+	if options == nil {
+		options = &ExtractOptions{}
+	}
+
+	if name := unsupportedOption(options, "Filters", "NoOverride", "ReadBufferSize", "SanitizeNames"); name != "" {
+		return fmt.Errorf("Option %s is not supported by ExtractSandboxed", name)
+	}
+
+	reader, err := newReader(fileName, options.ReadBufferSize)
+	if err != nil {
+		return err
+	}
+
+	defer reader.closeWithError(&err)
+
+	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	return extractSandboxed(reader, targetDir, options)
+}
+
+// ExtractStream extracts the files from a tar stream into a target
+// directory, the compression is detected from the stream itself.
+func ExtractStream(r io.Reader, targetDir string, options *ExtractOptions) (err error) {
+	if options == nil {
+		options = &ExtractOptions{}
+	}
+
+	reader, err := newStreamReader(r, options.ReadBufferSize)
+	if err != nil {
+		return err
+	}
+
+	defer reader.closeWithError(&err)
+
+	return extract(reader, targetDir, options, nil, nil)
+}
+
+// extract extracts the files from a tar reader into a target directory.
+// If `occurrences` is not nil only the last occurrence of each entry
+// is extracted. If `match` is not nil only the entries for which it
+// returns true are extracted.
+func extract(reader *tarReader, targetDir string, options *ExtractOptions, occurrences map[string]int, match func(name string) (bool, error)) error {
+	if err := os.MkdirAll(targetDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	resolvedTargetDir, err := resolvePath(targetDir)
+	if err != nil {
+		return err
+	}
+
+	// To improve performance the filters are prepared before.
+	filters := prepareFilters(options.Filters)
+
+	var usedFilters []bool
+	if options.UnusedFilterFunc != nil {
+		usedFilters = make([]bool, len(filters))
+	}
+
+	subtreePrefix := ""
+	if options.SubtreePrefix != "" {
+		subtreePrefix = filepath.Clean(options.SubtreePrefix) + string(os.PathSeparator)
+	}
+
+	var manifest *Manifest
+	if options.VerifyManifest != "" {
+		var err error
+		if manifest, err = readManifest(options.VerifyManifest); err != nil {
+			return err
+		}
+		reader.digest = sha256.New()
+	}
+
+	reader.textConvert = options.TextConvert
+	reader.preserveDevices = options.PreserveDevices
+	reader.skeletonOnly = options.SkeletonOnly
+	reader.preAllocate = options.PreAllocate
+
+	dirHeaders := map[string]*tar.Header{}
+
+	// Deduplicated entries are copied from the files extracted before
+	extractedFiles := map[string]string{}
+
+	appleDoubles := map[string][]byte{}
+
+	// The bytes written are counted, the size in the header of compressed
+	// and deduplicated entries is not the size of their content
+	if options.MaxTotalSize > 0 {
+		reader.sizeLimit = &sizeLimit{max: options.MaxTotalSize}
+	}
+
+	// Symlinks extracted as copies, by name in the tar file
+	symlinkCopies := map[string]symlinkCopy{}
+
+	excludedDir := ""
+
+	var extractedFilesLock sync.Mutex
+
+	// finish applies the options to an entry once it is extracted,
+	// it is called by the workers for the files they extract
+	finish := func(r *tarReader, targetFileName string) error {
+		// Files kept by NoOverride are left as they are
+		if !r.extracted {
+			return nil
+		}
+
+		// Deduplicated entries are not copied from an entry replaced since
+		extractedFilesLock.Lock()
+		if r.header.Typeflag == tar.TypeReg {
+			extractedFiles[path.Clean(r.header.Name)] = targetFileName
+		} else {
+			delete(extractedFiles, path.Clean(r.header.Name))
+		}
+		extractedFilesLock.Unlock()
+
+		if options.PreserveTimes || options.PreserveAccessTime {
+			// The mtime of a directory changes as its contents are extracted
+			if r.header.FileInfo().IsDir() {
+				dirHeaders[targetFileName] = r.header
+			} else if r.header.Typeflag != tar.TypeSymlink {
+				if err := setTimes(targetFileName, r.header, options.PreserveAccessTime); err != nil {
+					return err
+				}
+			} else if err := setSymlinkTimes(targetFileName, r.header, options.PreserveAccessTime); err != nil {
+				// Chtimes would set the times of the file the symlink points to
+				return err
+			}
+		}
+
+		if capability, ok := r.header.PAXRecords[paxCapability]; ok && options.PreserveCaps {
+			if err := setCapability(targetFileName, []byte(capability)); err != nil {
+				return fmt.Errorf("Restoring capabilities of %s: %v", targetFileName, err)
+			}
+		}
+
+		if options.PreserveOwner {
+			if err := setOwner(targetFileName, r.header, options.UIDMap, options.GIDMap); err != nil {
+				return err
+			}
+		}
+
+		if options.ReadOnly && r.header.FileInfo().Mode().IsRegular() {
+			mode := r.header.FileInfo().Mode().Perm() &^ 0222
+			if err := os.Chmod(targetFileName, mode); err != nil {
+				return err
+			}
+		}
+
+		if manifest != nil && r.sum != nil {
+			if err := manifest.verify(path.Clean(r.header.Name), r.sum); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// Regular files are written by a pool of workers with Concurrency
+	var pool *workerPool
+	pending := map[string]bool{}
+	if options.Concurrency > 1 {
+		pool = newWorkerPool(options.Concurrency)
+		defer pool.close()
+	}
+
+	for {
+		// A worker failed, the next entries are not extracted
+		if pool != nil {
+			if err := pool.firstError(); err != nil {
+				return err
+			}
+		}
+
+		err := reader.Next()
+		if err == io.EOF {
+			if pool != nil {
+				if err := pool.wait(); err != nil {
+					return err
+				}
+			}
+			if err := copySymlinks(symlinkCopies, extractedFiles, options.NoOverride); err != nil {
+				return err
+			}
+			for fileName, content := range appleDoubles {
+				if err := mergeAppleDouble(fileName, content); err != nil {
+					return err
+				}
+			}
+			for dirName, header := range dirHeaders {
+				if err := setTimes(dirName, header, options.PreserveAccessTime); err != nil {
+					return err
+				}
+			}
+			if err := reader.drain(); err != nil {
+				return err
+			}
+			if usedFilters != nil {
+				reportUnusedFilters(options.Filters, usedFilters, options.UnusedFilterFunc)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if occurrences != nil {
+			name := path.Clean(reader.header.Name)
+			if occurrences[name]--; occurrences[name] > 0 {
+				continue
+			}
+		}
+
+		// Removes the last slash to avoid different behaviors when `header.Name` is a folder
+		targetFileName := filepath.Clean(reader.header.Name)
+
+		// Control characters may be used to spoof names on terminals
+		if sanitized, ok := sanitizeName(targetFileName); !ok {
+			if !options.SanitizeNames {
+				return fmt.Errorf("Invalid entry name %q", reader.header.Name)
+			}
+			targetFileName = sanitized
+		}
+
+		// The entries under the last directory excluded by the filters
+		// cannot match, so they are skipped without matching them
+		if excludedDir != "" && strings.HasPrefix(targetFileName, excludedDir) {
+			continue
+		}
+
+		if usedFilters != nil {
+			markFilters(targetFileName, filters, usedFilters)
+		}
+
+		// Check if we have to extact the current file based on the user filters
+		if !optimizedMatches(targetFileName, filters) {
+			if reader.header.FileInfo().IsDir() {
+				excludedDir = targetFileName + string(os.PathSeparator)
+			}
+			continue
+		}
+
+		if match != nil {
+			matched, err := match(filepath.ToSlash(targetFileName))
+			if err != nil {
+				return err
+			}
+			if !matched {
+				continue
+			}
+		}
+
+		if len(options.TypeFilter) > 0 && bytes.IndexByte(options.TypeFilter, reader.header.Typeflag) < 0 {
+			continue
+		}
+
+		if options.SymlinkMode == SymlinkSkip && reader.header.Typeflag == tar.TypeSymlink {
+			continue
+		}
+
+		// Only entries under SubtreePrefix are extracted and the prefix
+		// is removed from their names
+		if subtreePrefix != "" {
+			if !strings.HasPrefix(targetFileName, subtreePrefix) {
+				continue
+			}
+			targetFileName = targetFileName[len(subtreePrefix):]
+		}
+
+		// If FlatDir is true we have to extract all files into root folder
+		// and we have to ignore all sub directories
+		if options.FlatDir {
+			if reader.header.Typeflag == tar.TypeDir || reader.header.Typeflag == typeGNUDumpDir {
+				continue
+			}
+			targetFileName = filepath.Base(targetFileName)
+		}
+
+		if options.RenameFunc != nil {
+			name, ok := options.RenameFunc(filepath.ToSlash(targetFileName))
+			if !ok {
+				continue
+			}
+			targetFileName = filepath.Clean(filepath.FromSlash(name))
+		}
+
+		if options.WriterFor != nil {
+			if writer, ok := options.WriterFor(reader.header); ok {
+				body, err := reader.openBody(nil)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(writer, body)
+				body.Close()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if options.MaxDepth > 0 && pathDepth(targetFileName) > options.MaxDepth {
+			return ErrDepthLimitExceeded
+		}
+
+		if !options.FollowSymlinks {
+			if err := checkSymlinks(targetDir, targetFileName); err != nil {
+				return err
+			}
+		}
+
+		if reader.header.Mode&0777 == 0 {
+			applyDefaultMode(reader.header, options)
+		}
+
+		// If `targetFileName` is an absolute path we are going to extract it
+		// relative to the `targetDir`
+		targetFileName = path.Join(targetDir, targetFileName)
+
+		// Names like `../a.txt` would be extracted outside `targetDir`
+		if !isWithin(targetDir, targetFileName) {
+			return ErrPathTraversal
+		}
+
+		// Lstat does not report every kind of link, like NTFS junctions,
+		// so the parent directory is resolved as well. The parent of
+		// a `./` entry is the parent of the target directory.
+		if !options.FollowSymlinks && targetFileName != path.Clean(targetDir) {
+			if err := checkJail(resolvedTargetDir, targetFileName); err != nil {
+				return err
+			}
+		}
+
+		targetFileName = fixLongPath(targetFileName)
+
+		// AppleDouble entries are merged once all entries are extracted,
+		// into the file next to them which went through the same checks
+		if options.MergeAppleDouble && appleDoubleSupported && strings.HasPrefix(filepath.Base(targetFileName), "._") {
+			body, err := reader.openBody(nil)
+			if err != nil {
+				return err
+			}
+			content, err := ioutil.ReadAll(body)
+			body.Close()
+			if err != nil {
+				return err
+			}
+			name := filepath.Join(filepath.Dir(targetFileName), filepath.Base(targetFileName)[2:])
+			appleDoubles[name] = content
+			continue
+		}
+
+		// The file a symlink points to may come later in the tar file
+		if options.SymlinkMode == SymlinkCopy && reader.header.Typeflag == tar.TypeSymlink {
+			symlinkCopies[path.Clean(reader.header.Name)] = symlinkCopy{
+				fileName: targetFileName,
+				linkname: reader.header.Linkname,
+			}
+			continue
+		}
+
+		// Deduplicated entries are copied from files which must be complete
+		_, dedup := reader.header.PAXRecords[paxDedup]
+		typeflag := reader.header.Typeflag
+		regular := (typeflag == tar.TypeReg || typeflag == tar.TypeRegA) && !isSparse(reader.header) && !dedup
+
+		// Large files are written here rather than read into memory,
+		// placeholders have no content to read
+		pooled := pool != nil && regular && (reader.header.Size <= concurrentEntrySize || options.SkeletonOnly)
+
+		if pool != nil && (pending[targetFileName] || !regular) {
+			// Other entries wait for the files being written, so no
+			// symlink is created where a worker writes a file
+			if err := pool.wait(); err != nil {
+				return err
+			}
+			pending = map[string]bool{}
+		}
+
+		reader.dedupSource = ""
+		var original io.ReadCloser
+		if name, ok := reader.header.PAXRecords[paxDedup]; ok {
+			source, ok := extractedFiles[path.Clean(name)]
+			// The file extracted may have been replaced by another entry,
+			// like a symlink pointing outside the target directory
+			if ok && regularFileWithin(resolvedTargetDir, source) {
+				reader.dedupSource = source
+			} else {
+				// The original entry was not extracted, like when the
+				// filters exclude it, so its content is read again
+				if _, original, err = openOriginal(reader.fileName, reader.header); err != nil {
+					return err
+				}
+				reader.body = original
+			}
+		}
+
+		if pooled {
+			// The parent directories are created here rather than by the
+			// workers, before any later symlink entry is extracted
+			if err := os.MkdirAll(filepath.Dir(targetFileName), os.ModePerm); err != nil {
+				return err
+			}
+			entry, err := reader.buffered()
+			if err != nil {
+				return err
+			}
+			pending[targetFileName] = true
+			fileName := targetFileName
+			pool.submit(func() error {
+				if err := entry.Extract(fileName, options.NoOverride); err != nil {
+					return err
+				}
+				return finish(entry, fileName)
+			})
+			continue
+		}
+
+		err = reader.Extract(targetFileName, options.NoOverride)
+		if original != nil {
+			original.Close()
+			reader.body = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := finish(reader, targetFileName); err != nil {
+			return err
+		}
+	}
+}
+
+// ExtractToMap reads the regular files of a tar file into memory,
+// keyed by their names. Directories and symlinks are omitted.
+// If `limit` is greater than zero and the files add up to more than
+// `limit` bytes ErrSizeLimitExceeded is returned.
+func ExtractToMap(fileName string, limit int64) (map[string][]byte, error) {
+	items, err := ReadAll(fileName, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{}
+
+	for _, item := range items {
+		if item.Header.Typeflag == tar.TypeReg || item.Header.Typeflag == tar.TypeRegA {
+			files[path.Clean(item.Header.Name)] = item.Data
+		}
+	}
+
+	return files, nil
+}
+
+// ReadAll reads the headers of all entries of a tar file into memory,
+// in order, along with the content of the regular files.
+// If `limit` is greater than zero and the files add up to more than
+// `limit` bytes ErrSizeLimitExceeded is returned.
+func ReadAll(fileName string, limit int64) ([]Item, error) {
+	reader, err := newReader(fileName, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	items := []Item{}
+	total := int64(0)
+
+	// Deduplicated entries have the content of a previous entry
+	kept := map[string][]byte{}
+
+	for {
+		err := reader.Next()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		item := Item{Header: reader.header}
+
+		if reader.header.Typeflag == tar.TypeReg || reader.header.Typeflag == tar.TypeRegA {
+			body, err := reader.openBody(kept)
+			if err != nil {
+				return nil, err
+			}
+
+			// The bytes read are counted as entries may be decompressed
+			var src io.Reader = body
+			if limit > 0 {
+				src = io.LimitReader(body, limit-total+1)
+			}
+
+			item.Data, err = ioutil.ReadAll(src)
+			body.Close()
+			if err != nil {
+				return nil, err
+			}
+
+			total += int64(len(item.Data))
+			if limit > 0 && total > limit {
+				return nil, ErrSizeLimitExceeded
+			}
+
+			if _, ok := kept[path.Clean(reader.header.Name)]; !ok {
+				kept[path.Clean(reader.header.Name)] = item.Data
+			}
+		}
+
+		items = append(items, item)
+	}
+}
+
+// ExtractToTemp extracts the files from a tar file into a new temporary
+// directory, `cleanup` removes it once its files are no longer needed.
+// Use MaxTotalSize to bound the space taken by the directory.
+func ExtractToTemp(fileName string, options *ExtractOptions) (dir string, cleanup func() error, err error) {
+	if dir, err = ioutil.TempDir("", "tarx"); err != nil {
+		return "", nil, err
+	}
+
+	if err := Extract(fileName, dir, options); err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	return dir, func() error { return os.RemoveAll(dir) }, nil
+}
+
+// ExtractAtomic extracts the files from a tar file into a temporary
+// directory next to `targetDir` and then swaps it with `targetDir`.
+// If the extraction fails `targetDir` is left untouched.
+func ExtractAtomic(fileName, targetDir string, options *ExtractOptions) error {
+	targetDir = filepath.Clean(targetDir)
+	parentDir, baseName := filepath.Split(targetDir)
+	if parentDir == "" {
+		parentDir = "."
+	}
+
+	if err := os.MkdirAll(parentDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// The temporary directory must be in the same file system
+	// as `targetDir` to be renamed
+	tempDir, err := ioutil.TempDir(parentDir, "."+baseName+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if err := Extract(fileName, tempDir, options); err != nil {
+		os.RemoveAll(tempDir)
+		return err
+	}
+
+	backupDir := ""
+
+	if _, err := os.Lstat(targetDir); err == nil {
+		backupDir = tempDir + ".old"
+		if err := os.Rename(targetDir, backupDir); err != nil {
+			os.RemoveAll(tempDir)
+			return err
+		}
+	}
+
+	if err := os.Rename(tempDir, targetDir); err != nil {
+		// Puts the old directory back in place
+		if backupDir != "" {
+			os.Rename(backupDir, targetDir)
+		}
+		os.RemoveAll(tempDir)
+		return err
+	}
+
+	if backupDir != "" {
+		return os.RemoveAll(backupDir)
+	}
+
+	return nil
+}
+
+// ExtractGlob extracts the entries matching a glob pattern into a
+// target directory and returns how many entries were extracted.
+// Besides the `path.Match` syntax, `**` matches any number of directories.
+// The entries are checked like the ones extracted by Extract.
+func ExtractGlob(fileName, targetDir, pattern string) (count int, err error) {
+	reader, err := newReader(fileName, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	defer reader.closeWithError(&err)
+
+	patternDirs := strings.Split(path.Clean(pattern), "/")
+
+	match := func(name string) (bool, error) {
+		matched, err := globMatches(patternDirs, strings.Split(name, "/"))
+		if matched {
+			count++
+		}
+		return matched, err
+	}
+
+	err = extract(reader, targetDir, &ExtractOptions{}, nil, match)
+
+	return count, err
+}
+
+// Merge writes all entries from the source tar files into a tar file,
+// each source may use a different compression.
+// Duplicated entry names are handled by `options.Collision`.
+func Merge(fileName string, srcNames []string, options *CompressOptions) error {
+	if options == nil {
+		options = &CompressOptions{}
+	}
+
+	writer, err := newWriter(fileName, options)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+
+	keep := func(header *tar.Header) (bool, error) {
+		name := path.Clean(header.Name)
+		if seen[name] {
+			if options.Collision == CollisionError {
+				return false, ErrDuplicateEntry
+			}
+			return false, nil
+		}
+		seen[name] = true
+		return true, nil
+	}
+
+	for _, srcName := range srcNames {
+		if err = copyEntries(writer, srcName, keep); err != nil {
+			break
+		}
+	}
+
+	// If any error occurs we delete the tar file
+	writer.Close(err != nil)
+
+	return err
+}
+
+// Filter writes the entries from a source tar file for which `keep`
+// returns true into a new tar file, one entry at a time.
+// The new tar file may use a different compression. Deduplicated entries
+// whose original is not kept are written with the content of the original.
+func Filter(srcName, fileName string, keep func(*tar.Header) bool, options *CompressOptions) error {
+	if options == nil {
+		options = &CompressOptions{}
+	}
+
+	writer, err := newWriter(fileName, options)
+	if err != nil {
+		return err
+	}
+
+	err = copyEntries(writer, srcName, func(header *tar.Header) (bool, error) {
+		return keep(header), nil
+	})
+
+	// If any error occurs we delete the tar file
+	writer.Close(err != nil)
+
+	return err
+}
+
+// NormalizeTimestamps writes the entries from a source tar file into
+// a new tar file with their mtime, and atime and ctime if set, changed
+// to `t`. The new tar file uses the compression of the source, except
+// for bzip2 which is written with gzip.
+func NormalizeTimestamps(srcName, fileName string, t time.Time) error {
+	file, err := os.Open(srcName)
+	if err != nil {
+		return err
+	}
+
+	compression, err := detectCompression(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	if compression == Bzip2 {
+		compression = Gzip
+	}
+
+	return Filter(srcName, fileName, func(header *tar.Header) bool {
+		header.ModTime = t
+		if !header.AccessTime.IsZero() {
+			header.AccessTime = t
+		}
+		if !header.ChangeTime.IsZero() {
+			header.ChangeTime = t
+		}
+		return true
+	}, &CompressOptions{Compression: compression})
+}
+
+// copyEntries copies the entries from a tar file into `writer`
+// for which `keep` returns true. The checksum entry is not copied as it
+// would not match the new tar file, AppendChecksum writes a new one.
+func copyEntries(writer *tarWriter, srcName string, keep func(*tar.Header) (bool, error)) error {
+	reader, err := newReader(srcName, 0)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	// Whether the first entry with each name was kept, as deduplicated
+	// entries reference the first entry with a name of the same tar file
+	kept := map[string]bool{}
+
+	for {
+		err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if reader.header.Name == ChecksumEntryName {
+			continue
+		}
+
+		ok, err := keep(reader.header)
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(reader.header.Name)
+		if _, seen := kept[name]; !seen {
+			kept[name] = ok
+		}
+
+		if !ok {
+			continue
+		}
+
+		// The reference would be dangling, or resolve to another file, so
+		// the entry gets the content of its original instead
+		if original, ok := reader.header.PAXRecords[paxDedup]; ok && !kept[path.Clean(original)] {
+			if err := copyOriginal(writer, srcName, reader.header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := writer.writeHeader(reader.header); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(writer.body(), reader.reader); err != nil {
+			return err
+		}
+	}
+}
+
+// copyOriginal writes a deduplicated entry into `writer` as a regular
+// entry with the content of the entry it references.
+func copyOriginal(writer *tarWriter, srcName string, header *tar.Header) error {
+	originalHeader, original, err := openOriginal(srcName, header)
+	if err != nil {
+		return err
+	}
+
+	defer original.Close()
+
+	entry := *header
+	entry.Size = entrySize(originalHeader)
+	entry.PAXRecords = map[string]string{}
+	for key, value := range header.PAXRecords {
+		if key != paxDedup {
+			entry.PAXRecords[key] = value
+		}
+	}
+
+	if err := writer.writeHeader(&entry); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer.body(), original)
+	return err
+}
+
+// Find returns the header and ReadCloser for the entry in the tarfile
+// that matches the filename. If nothing matches, an `os.ErrNotExists`
+// error is returned.
+// If the `targetFileName` is not a regular file it returns a reader `nil`.
+func Find(fileName, targetFileName string) (*tar.Header, io.ReadCloser, error) {
+	return find(fileName, targetFileName, true)
+}
+
+// find is Find, the content of deduplicated entries is the one of their
+// original entry if `resolveDedup` is true.
+func find(fileName, targetFileName string, resolveDedup bool) (*tar.Header, io.ReadCloser, error) {
+	reader, err := newReader(fileName, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	targetFileName = path.Clean(targetFileName)
+
+	for {
+		header, err := reader.reader.Next()
+		if err == io.EOF {
+			reader.Close()
+			return nil, nil, os.ErrNotExist
+		}
+		if err != nil {
+			reader.Close()
+			return nil, nil, err
+		}
+
+		// If the file found is not a regular file we don't return a reader
+		if targetFileName == path.Clean(header.Name) {
+			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+				if _, ok := header.PAXRecords[paxDedup]; ok && resolveDedup {
+					reader.Close()
+					_, original, err := openOriginal(fileName, header)
+					return header, original, err
+				}
+				if isEntryCompressed(header) {
+					entryReader, err := newGzipEntryReader(reader)
+					return header, entryReader, err
+				}
+				return header, reader, nil
+			}
+			reader.Close()
+			return header, nil, nil
+		}
+	}
+}
+
+// OpenAt opens a tar file starting `offset` bytes into a file, like one
+// appended to an executable, the compression is detected at that offset.
+func OpenAt(fileName string, offset int64) (*Reader, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader, err := newStreamReader(file, 0)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader.file = file
+
+	return &Reader{reader: reader}, nil
+}
+
+// Next advances to the next entry, it returns io.EOF at the end of the tar file.
+func (r *Reader) Next() (*tar.Header, error) {
+	if err := r.closeBody(); err != nil {
+		return nil, err
+	}
+
+	for {
+		err := r.reader.Next()
+		if err == io.EOF && len(r.next) > 0 {
+			if err := r.openNext(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// An entry whose content cannot be read can still be skipped
+		r.body, r.err = r.reader.openBody(nil)
+
+		return r.reader.header, nil
+	}
+}
+
+// closeBody closes the content of the current entry
+func (r *Reader) closeBody() error {
+	body := r.body
+	r.body, r.err = nil, nil
+	if body == nil {
+		return nil
+	}
+	return body.Close()
+}
+
+// openNext closes the current tar file of Concat and opens the next one
+func (r *Reader) openNext() error {
+	// The next tar file is opened first, so Close still has one to close
+	reader, err := newReader(r.next[0], 0)
+	if err != nil {
+		return err
+	}
+
+	if err := r.reader.Close(); err != nil {
+		reader.Close()
+		return err
+	}
+
+	r.reader = reader
+	r.next = r.next[1:]
+
+	return nil
+}
+
+// Read reads the content of the current entry
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.body == nil {
+		return 0, io.EOF
+	}
+	return r.body.Read(p)
+}
+
+// Close closes the tar file
+func (r *Reader) Close() error {
+	err := r.closeBody()
+	if cerr := r.reader.Close(); err == nil {
+		err = cerr
+	}
+	for _, file := range r.files {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Concat reads the entries of several tar files one after the other as if
+// they were a single tar file, each tar file is opened once the entries
+// of the previous one are read.
+func Concat(fileNames []string) (*Reader, error) {
+	if len(fileNames) == 0 {
+		return nil, errors.New("No tar files to concatenate")
+	}
+
+	reader, err := newReader(fileNames[0], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{reader: reader, next: fileNames[1:]}, nil
+}
+
+// Split copies a tar file into volumes of at most `maxBytes` bytes named
+// `fileName.001`, `fileName.002` and so on, and returns their names.
+// Volumes of uncompressed tar files end between entries unless an entry
+// does not fit in a volume. Concatenating the volumes gives the tar file
+// back, see OpenSplit.
+func Split(fileName string, maxBytes int64) ([]string, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("Invalid volume size %d", maxBytes)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := detectCompression(file)
+	if err != nil {
+		return nil, err
+	}
+
+	// The entries of compressed tar files cannot be located
+	var boundaries []int64
+	if compression == Uncompressed {
+		index, err := Index(fileName)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range index {
+			boundaries = append(boundaries, (entry.Offset+entry.Size+511)&^511)
+		}
+	}
+
+	names := []string{}
+
+	for start := int64(0); start < info.Size(); {
+		end := start + maxBytes
+		if end >= info.Size() {
+			end = info.Size()
+		} else {
+			// The last entry ending within the volume, if any
+			for i := len(boundaries) - 1; i >= 0; i-- {
+				if boundaries[i] > start && boundaries[i] <= end {
+					end = boundaries[i]
+					break
+				}
+			}
+		}
+
+		name := fmt.Sprintf("%s.%03d", fileName, len(names)+1)
+		if err := copySection(file, name, start, end-start); err != nil {
+			for _, name := range names {
+				os.Remove(name)
+			}
+			return nil, err
+		}
+
+		names = append(names, name)
+		start = end
+	}
+
+	return names, nil
+}
+
+// copySection copies `size` bytes of a file from `offset` into a new file
+func copySection(file *os.File, fileName string, offset, size int64) (err error) {
+	out, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(fileName)
+		}
+	}()
+
+	_, err = io.Copy(out, io.NewSectionReader(file, offset, size))
+	return err
+}
+
+// OpenSplit opens a tar file split into volumes, like the ones written
+// by Split, the volumes are read one after the other in the order given.
+func OpenSplit(fileNames []string) (*Reader, error) {
+	files := []*os.File{}
+	readers := []io.Reader{}
+
+	for _, fileName := range fileNames {
+		file, err := os.Open(fileName)
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+		readers = append(readers, file)
+	}
+
+	reader, err := newStreamReader(io.MultiReader(readers...), 0)
+	if err != nil {
+		for _, file := range files {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	return &Reader{reader: reader, files: files}, nil
+}
+
+// Stat returns the header of an entry of a tar file without opening
+// its content. If nothing matches, an `os.ErrNotExists` error is returned.
+func Stat(fileName, entryName string) (*tar.Header, error) {
+	reader, err := newReader(fileName, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	entryName = path.Clean(entryName)
+
+	// Only the headers are read, the bodies are skipped
+	for {
+		header, err := reader.reader.Next()
+		if err == io.EOF {
+			return nil, os.ErrNotExist
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if path.Clean(header.Name) == entryName {
+			return header, nil
+		}
+	}
+}
+
+// PAXRecords returns the PAX records of an entry of a tar file,
+// including custom keywords like `SCHILY.*` or `LIBARCHIVE.*`.
+// If nothing matches, an `os.ErrNotExists` error is returned.
+func PAXRecords(fileName, entryName string) (map[string]string, error) {
+	header, err := Stat(fileName, entryName)
+	if err != nil {
+		return nil, err
+	}
+
+	return header.PAXRecords, nil
+}
+
+// List lists all entries from a tar file.
+func List(fileName string) ([]*tar.Header, error) {
+	return ListContext(context.Background(), fileName, nil)
+}
+
+// ListContext lists all entries from a tar file, it stops as soon as
+// the context is done and returns `ctx.Err()`.
+// If `fn` is not nil it is called for each entry as it is read.
+func ListContext(ctx context.Context, fileName string, fn func(*tar.Header)) (headers []*tar.Header, err error) {
+	reader, err := newReader(fileName, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.closeWithError(&err)
+
+	headers = []*tar.Header{}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		err := reader.Next()
+		if err == io.EOF {
+			if err := reader.drain(); err != nil {
+				return nil, err
+			}
+			return headers, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		headers = append(headers, reader.header)
+
+		if fn != nil {
+			fn(reader.header)
+		}
+	}
+}
+
+// CountMatching returns the number of entries of a tar file matching
+// filters the way the Filters option of Extract does, to check filters
+// before extracting.
+func CountMatching(fileName string, filters []string) (int, error) {
+	headers, err := List(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	preparedFilters := prepareFilters(filters)
+	count := 0
+
+	for _, header := range headers {
+		if optimizedMatches(filepath.Clean(header.Name), preparedFilters) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// ListEntries lists all entries from a tar file without exposing
+// the archive/tar types.
+func ListEntries(fileName string) ([]Entry, error) {
+	headers, err := List(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, len(headers))
+
+	for i, header := range headers {
+		info := header.FileInfo()
+		entries[i] = Entry{
+			Name:    path.Clean(header.Name),
+			Size:    header.Size,
+			Mode:    info.Mode(),
+			ModTime: header.ModTime,
+			IsDir:   info.IsDir(),
+		}
+	}
+
+	return entries, nil
+}
+
+// OpenWithIndex opens the body of an entry of an uncompressed tar file
+// using the index written by WriteIndex, without reading the entries
+// before it. If the entry is not in the index, an `os.ErrNotExists`
+// error is returned. Deduplicated entries return the body they reference.
+func OpenWithIndex(fileName, entryName string) (io.ReadCloser, error) {
+	content, err := ioutil.ReadFile(fileName + indexExtension)
+	if err != nil {
+		return nil, err
+	}
+
+	var index []IndexEntry
+	if err := json.Unmarshal(content, &index); err != nil {
+		return nil, err
+	}
+
+	entryName = path.Clean(entryName)
+
+	// The last entry wins if the name is duplicated
+	for i := len(index) - 1; i >= 0; i-- {
+		if index[i].Name != entryName {
+			continue
+		}
+
+		entry := index[i]
+
+		// The body is the one of the first entry with the name referenced
+		if original := entry.Dedup; original != "" {
+			found := false
+			for _, e := range index {
+				if e.Name == path.Clean(original) {
+					entry, found = e, true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("Entry %q references %q which does not exist", entryName, original)
+			}
+			if entry.Dedup != "" {
+				return nil, fmt.Errorf("Entry %q references %q which is not a regular file", entryName, original)
+			}
+		}
+
+		file, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		reader := &sectionReadCloser{
+			SectionReader: io.NewSectionReader(file, entry.Offset, entry.Size),
+			file:          file,
+		}
+
+		if !entry.Compressed {
+			return reader, nil
+		}
+
+		return newGzipEntryReader(reader)
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// writeIndex writes the index of a tar file as JSON
+func writeIndex(fileName string, index []IndexEntry) error {
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fileName, content, 0644)
+}
+
+// TopLevelEntries returns the unique first path components of the
+// entries of a tar file, in the order they appear.
+func TopLevelEntries(fileName string) ([]string, error) {
+	headers, err := List(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	seen := map[string]bool{}
+
+	for _, header := range headers {
+		name := strings.TrimLeft(path.Clean(header.Name), "/")
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i]
+		}
+		if name == "." || name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// DetectFormat detects the container format of a file from its
+// leading bytes, the content of compressed files is not checked.
+func DetectFormat(fileName string) (Format, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return FormatUnknown, err
+	}
+
+	defer file.Close()
+
+	block := make([]byte, 512)
+	n, err := io.ReadFull(file, block)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return FormatUnknown, nil
+		}
+		return FormatUnknown, err
+	}
+
+	return formatOf(block[:n]), nil
+}
+
+// ReadFile returns the content of a regular file of a tar file or of a
+// zip file, the format is detected from the file. If nothing matches,
+// an `os.ErrNotExist` error is returned.
+func ReadFile(fileName, entryName string) ([]byte, error) {
+	format, err := DetectFormat(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == FormatZip {
+		return readZipFile(fileName, entryName)
+	}
+
+	header, reader, err := Find(fileName, entryName)
+	if err != nil {
+		return nil, err
+	}
+
+	if reader == nil {
+		return nil, fmt.Errorf("Entry %s is not a regular file", header.Name)
+	}
+
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// readZipFile returns the content of a file of a zip file
+func readZipFile(fileName, entryName string) ([]byte, error) {
+	reader, err := zip.OpenReader(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	entryName = path.Clean(entryName)
+
+	for _, file := range reader.File {
+		if path.Clean(file.Name) != entryName {
+			continue
+		}
+
+		if !file.Mode().IsRegular() {
+			return nil, fmt.Errorf("Entry %s is not a regular file", file.Name)
+		}
+
+		content, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		defer content.Close()
+
+		return ioutil.ReadAll(content)
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// Index returns the offset and size of the body of each entry
+// from an uncompressed tar file, so the entries can be read directly later.
+func Index(fileName string) ([]IndexEntry, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	compression, err := detectCompression(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if compression != Uncompressed {
+		return nil, ErrIndexNotSupported
+	}
+
+	// The counter must not be an io.Seeker, otherwise tar.Reader
+	// skips the bodies without us knowing
+	counter := &countingReader{Reader: file}
+	reader := tar.NewReader(counter)
+
+	entries := []IndexEntry{}
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, IndexEntry{
+			Name:       path.Clean(header.Name),
+			Offset:     counter.Count,
+			Size:       header.Size,
+			Compressed: isEntryCompressed(header),
+			Dedup:      header.PAXRecords[paxDedup],
+		})
+	}
+}
+
+// Diff compares the entries of a tar file with the files of a directory.
+// Directory mtimes are not compared because they change whenever
+// their contents change.
+func Diff(fileName, dir string) (*DiffResult, error) {
+	headers, err := List(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DiffResult{Missing: []string{}, Extra: []string{}, Changed: []string{}}
+	names := map[string]bool{}
+
+	// The sizes of the contents of the first entry with each name,
+	// deduplicated entries have the size of the entry they reference
+	sizes := map[string]int64{}
+
+	for _, header := range headers {
+		name := path.Clean(header.Name)
+		names[name] = true
+
+		size := entrySize(header)
+		if original, ok := header.PAXRecords[paxDedup]; ok {
+			size = sizes[path.Clean(original)]
+		}
+		if _, ok := sizes[name]; !ok {
+			sizes[name] = size
+		}
+
+		fileInfo, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			result.Missing = append(result.Missing, name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if headerChanged(header, size, fileInfo) {
+			result.Changed = append(result.Changed, name)
+		}
+	}
+
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relFilePath, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		if relFilePath == "." {
+			return nil
+		}
+
+		if name := filepath.ToSlash(relFilePath); !names[name] {
+			result.Extra = append(result.Extra, name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ValidateStructure checks that all headers of a tar file can be read
+// up to its end, the bodies of the entries are skipped.
+// It is faster than Verify but it does not validate the content.
+// If the tar file cannot be read a *CorruptError is returned.
+func ValidateStructure(fileName string) error {
+	reader, err := newReader(fileName, 0)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	lastEntry := ""
+
+	for {
+		err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return reader.corruptError(lastEntry, err)
+		}
+		lastEntry = reader.header.Name
+	}
+}
+
+// Verify checks the checksum entry written by AppendChecksum against
+// the bodies of all entries of a tar file.
+// If the tar file cannot be read a *CorruptError is returned.
+func Verify(fileName string) error {
+	reader, err := newReader(fileName, 0)
+	if err != nil {
+		return err
+	}
+
+	defer reader.Close()
+
+	checksum := sha256.New()
+	lastEntry := ""
+
+	for {
+		err := reader.Next()
+		if err == io.EOF {
+			return ErrChecksumNotFound
+		}
+		if err != nil {
+			return reader.corruptError(lastEntry, err)
+		}
+
+		if reader.header.Name != ChecksumEntryName {
+			if _, err := io.Copy(checksum, reader); err != nil {
+				return reader.corruptError(lastEntry, err)
+			}
+			lastEntry = reader.header.Name
+			continue
+		}
+
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return reader.corruptError(lastEntry, err)
+		}
+
+		if strings.TrimSpace(string(content)) != hex.EncodeToString(checksum.Sum(nil)) {
+			return ErrChecksumMismatch
+		}
+
+		// The checksum must be the last entry
+		if err := reader.Next(); err != io.EOF {
+			if err == nil {
+				return ErrChecksumMismatch
+			}
+			return reader.corruptError(ChecksumEntryName, err)
+		}
+
+		return nil
+	}
+}
+
+// ContentHash returns a SHA-256 of the names, modes and contents of the
+// entries of a tar file which does not depend on their order nor on their
+// times, so tar files with the same contents have the same hash.
+// The checksum entry written by AppendChecksum is left out.
+func ContentHash(fileName string) (string, error) {
+	reader, err := newReader(fileName, 0)
+	if err != nil {
+		return "", err
+	}
+
+	defer reader.Close()
+
+	sums := map[string][]byte{}
+	var lines []string
+
+	for {
+		err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if reader.header.Name == ChecksumEntryName {
+			continue
+		}
+
+		name := path.Clean(reader.header.Name)
+
+		// Deduplicated entries have the content of the original one
+		var sum []byte
+		if original, ok := reader.header.PAXRecords[paxDedup]; ok {
+			sum = sums[path.Clean(original)]
+		} else {
+			body, err := reader.openBody(nil)
+			if err != nil {
+				return "", err
+			}
+			checksum := sha256.New()
+			_, err = io.Copy(checksum, body)
+			body.Close()
+			if err != nil {
+				return "", err
+			}
+			sum = checksum.Sum(nil)
+		}
+		if _, ok := sums[name]; !ok {
+			sums[name] = sum
+		}
+
+		lines = append(lines, fmt.Sprintf("%q %c %o %q %x\n", name, reader.header.Typeflag, reader.header.Mode, reader.header.Linkname, sum))
+	}
+
+	sort.Strings(lines)
+
+	checksum := sha256.New()
+	for _, line := range lines {
+		io.WriteString(checksum, line)
+	}
+
+	return hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// newReader opens a tar file as readonly, compressed tar files are read
+// through a buffer of `bufferSize` bytes, if zero DefaultReadBufferSize is used.
+func newReader(fileName string, bufferSize int) (*tarReader, error) {
+	return newProgressReader(fileName, bufferSize, nil)
+}
+
+// newProgressReader opens a tar file like newReader, if `progress` is not
+// nil it is called with the bytes read from the file as they are read.
+func newProgressReader(fileName string, bufferSize int, progress func(read, total int64)) (*tarReader, error) {
+	file, err := os.OpenFile(fileName, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reads the header from the file to see which compression
+	// this file has been using.
+	compression, err := detectCompression(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var r io.Reader = file
+	var counter *progressReader
+
+	if progress != nil {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		counter = &progressReader{Reader: file, Total: info.Size(), Progress: progress}
+		r = counter
+	}
+
+	reader, err := newTarReader(r, compression, bufferSize)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader.file = file
+	reader.fileName = fileName
+	reader.progress = counter
+
+	return reader, nil
+}
+
+// newStreamReader reads a tar file from a stream, the compression is
+// detected by peeking at the first bytes of the stream.
+func newStreamReader(r io.Reader, bufferSize int) (*tarReader, error) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultReadBufferSize
+	}
+
+	buffered := bufio.NewReaderSize(r, bufferSize)
+
+	// An empty or tiny stream is handed over to tar.Reader as is
+	magic, err := buffered.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return newTarReader(buffered, compressionOf(magic), bufferSize)
+}
+
+// newTarReader wraps a reader with the decompressor for `compression`,
+// the decompressor reads through a buffer of `bufferSize` bytes.
+func newTarReader(r io.Reader, compression Compression, bufferSize int) (*tarReader, error) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultReadBufferSize
+	}
+
+	var compressReader io.ReadCloser
+	var err error
+
+	switch compression {
+	case Gzip:
+		if compressReader, err = gzip.NewReader(bufio.NewReaderSize(r, bufferSize)); err != nil {
+			return nil, err
+		}
+	case Bzip2:
+		compressReader = &readCloserWrapper{Reader: bzip2.NewReader(bufio.NewReaderSize(r, bufferSize))}
+	}
+
+	var reader *tar.Reader
+
+	if compressReader == nil {
+		reader = tar.NewReader(r)
+	} else {
+		reader = tar.NewReader(compressReader)
+	}
+
+	return &tarReader{
+		reader:         reader,
 		compressReader: compressReader,
 	}, nil
 }
 
-// newReader creates a new tar file on disk if `append=false` otherwise
-// it opens the tar file.
-func newWriter(fileName string, options *CompressOptions) (*tarWriter, error) {
-	var file *os.File
-	var err error
+// newReader creates a new tar file on disk if `append=false` otherwise
+// it opens the tar file.
+func newWriter(fileName string, options *CompressOptions) (*tarWriter, error) {
+	return openWriter(fileName, options, nil)
+}
+
+// openWriter is newWriter, if `volumes` is not nil the tar file is written
+// into its volumes instead.
+func openWriter(fileName string, options *CompressOptions, volumes *volumeWriter) (*tarWriter, error) {
+	var file *os.File
+	var output io.Writer
+	var err error
+
+	// The volumes are created as they are written
+	if volumes != nil {
+		output = volumes
+	} else {
+		if options.Append {
+			file, err = os.OpenFile(fileName, os.O_RDWR, os.ModePerm)
+		} else {
+			file, err = os.Create(fileName)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		output = file
+	}
+
+	// In case of error we close and remove the tar file
+	// if it was just created (append=false)
+	defer func() {
+		if err != nil && file != nil {
+			file.Close()
+
+			if !options.Append {
+				os.Remove(fileName)
+			}
+		}
+	}()
+
+	compression := options.Compression
+
+	var checksum hash.Hash
+	if options.AppendChecksum {
+		checksum = sha256.New()
+	}
+
+	if options.Append {
+		// Reads the header from the file to see which compression
+		// this file has been using.
+		if compression, err = detectCompression(file); err != nil {
+			return nil, err
+		}
+
+		// Appending only works for uncompressed tar files, the new entries
+		// overwrite the end-of-archive marker of the existing ones.
+		if compression != Uncompressed {
+			err = ErrAppendNotSupported
+			return nil, err
+		}
+
+		// A tar file resumed from a checkpoint may end with an entry
+		// cut off when the process was killed
+		var end int64
+		if end, err = findArchiveEnd(file, options.Checkpoint != ""); err != nil {
+			return nil, err
+		}
+
+		// The checksum covers the entries already in the tar file too
+		if options.AppendChecksum {
+			if checksum, err = hashBodies(file, end); err != nil {
+				return nil, err
+			}
+		}
+
+		// Drops the end-of-archive marker and any padding after it
+		if err = file.Truncate(end); err != nil {
+			return nil, err
+		}
+
+		if _, err = file.Seek(end, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	var compressWriter io.WriteCloser
+
+	switch compression {
+	case Gzip:
+		compressWriter = gzip.NewWriter(output)
+	case Bzip2:
+		err = ErrBzip2NotSupported
+		return nil, err
+	}
+
+	var writer *tar.Writer
+	var proxy *writerProxy
+
+	if compressWriter == nil {
+		writer = tar.NewWriter(output)
+	} else if options.AdaptiveCompression {
+		// The gzip writer is replaced whenever the level changes
+		proxy = &writerProxy{Writer: compressWriter}
+		writer = tar.NewWriter(proxy)
+	} else {
+		writer = tar.NewWriter(compressWriter)
+	}
+
+	var dedup map[string]string
+	if options.Dedup {
+		dedup = map[string]string{}
+	}
+
+	if options.PerEntryCompression && compression != Uncompressed {
+		err = ErrPerEntryNotSupported
+		return nil, err
+	}
+
+	// The entries already in the tar file are indexed as well
+	var index []IndexEntry
+	if options.WriteIndex {
+		if compression != Uncompressed {
+			err = ErrIndexNotSupported
+			return nil, err
+		}
+		index = []IndexEntry{}
+		if options.Append {
+			if index, err = Index(fileName); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &tarWriter{
+		file:           file,
+		fileName:       fileName,
+		output:         output,
+		volumes:        volumes,
+		writer:         writer,
+		compressWriter: compressWriter,
+		proxy:          proxy,
+		level:          gzip.DefaultCompression,
+		entryTimeout:   options.EntryTimeout,
+		preserveCaps:   options.PreserveCaps,
+		checksum:       checksum,
+		followSymlinks: options.FollowSymlinks,
+		append:         options.Append,
+		dedup:          dedup,
+		format:         options.Format,
+		index:          index,
+		perEntry:       options.PerEntryCompression,
+		sync:           options.Sync,
+		retry:          options.RetryFunc,
+	}, nil
+}
+
+// detectCompression detects which comperssion the tar file has been using.
+func detectCompression(file *os.File) (Compression, error) {
+	source := make([]byte, 3)
+
+	if _, err := file.ReadAt(source, 0); err != nil {
+		return Uncompressed, err
+	}
+
+	return compressionOf(source), nil
+}
+
+// compressionOf returns the compression matching the magic bytes
+// at the beginning of a tar file.
+func compressionOf(source []byte) Compression {
+	for compression, m := range map[Compression][]byte{
+		Bzip2: {0x42, 0x5A, 0x68},
+		Gzip:  {0x1F, 0x8B, 0x08},
+	} {
+		if len(source) < len(m) {
+			continue
+		}
+		if bytes.Compare(m, source[:len(m)]) == 0 {
+			return compression
+		}
+	}
+	return Uncompressed
+}
+
+// Extract extracts a tar file into disk
+func (r *tarReader) Extract(fileName string, noOverride bool) error {
+	r.sum = nil
+	r.extracted = false
+
+	fileInfo, err := os.Lstat(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// If the `fileName` already exists on disk and it is a file
+	// we try to delete it in order to create a new one unless
+	// `noOverride` is set to true
+	if err == nil && !fileInfo.IsDir() {
+		if noOverride {
+			return nil
+		}
+
+		if err := os.Remove(fileName); err != nil {
+			return err
+		}
+	}
+
+	// header.Mode is in linux format, we have to convert it to os.FileMode
+	// to be compatible to other platforms.
+	headerInfo := r.header.FileInfo()
+
+	// The parent directories may not have been extracted yet because
+	// they were filtered out or they come later in the tar file
+	if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+		return err
+	}
+
+	switch r.header.Typeflag {
+	case tar.TypeDir, typeGNUDumpDir:
+		// The content of a GNU incremental directory is just a listing
+		// of its files, we create the directory and ignore the listing.
+		if err := os.Mkdir(fileName, headerInfo.Mode()); err != nil && !os.IsExist(err) {
+			return err
+		}
+		// The directory may have been created by one of its children,
+		// so the mode is applied again.
+		if err := os.Chmod(fileName, headerInfo.Mode()); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		// Placeholders are created without reading the body
+		if r.skeletonOnly {
+			if err := createFile(fileName, headerInfo.Mode(), strings.NewReader("")); err != nil {
+				return err
+			}
+			break
+		}
+		var src io.Reader = r.reader
+		if r.body != nil {
+			src = r.body
+		}
+		if isEntryCompressed(r.header) {
+			gzipReader, err := gzip.NewReader(src)
+			if err != nil {
+				return err
+			}
+			src = gzipReader
+		}
+		// Deduplicated entries are copied from the file with the same content
+		if r.dedupSource != "" {
+			source, err := os.Open(r.dedupSource)
+			if err != nil {
+				return err
+			}
+			defer source.Close()
+			src = source
+		}
+		if r.digest != nil {
+			r.digest.Reset()
+			src = io.TeeReader(src, r.digest)
+		}
+		// archive/tar fills the holes of sparse files with zeros,
+		// we skip them again so the file is sparse on disk too
+		if isSparse(r.header) {
+			err = createSparseFile(fileName, headerInfo.Mode(), r.sizeLimit.reader(src), r.header.Size)
+		} else {
+			if r.textConvert != TextConvertOff {
+				src = newTextReader(src, r.textConvert)
+			}
+			src = r.sizeLimit.reader(src)
+			var prepare func(*os.File) error
+			if r.preAllocate {
+				size := entrySize(r.header)
+				prepare = func(file *os.File) error {
+					return fallocate(file, size)
+				}
+			}
+			err = createFileWith(fileName, headerInfo.Mode(), src, prepare)
+		}
+		if err != nil {
+			return err
+		}
+		if r.digest != nil {
+			r.sum = r.digest.Sum(nil)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(r.header.Linkname, fileName); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if !r.preserveDevices {
+			return fmt.Errorf("Entry %s is a device file, see PreserveDevices", r.header.Name)
+		}
+		if err := mknod(fileName, r.header); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unhandled tar header type %d", r.header.Typeflag)
+	}
+
+	r.extracted = true
+	return nil
+}
+
+// buffered reads the body of the current entry and returns a reader
+// extracting it on its own, like a worker of Concurrency does.
+// The body is not read with SkeletonOnly.
+func (r *tarReader) buffered() (*tarReader, error) {
+	entry := &tarReader{
+		header:          r.header,
+		textConvert:     r.textConvert,
+		preserveDevices: r.preserveDevices,
+		skeletonOnly:    r.skeletonOnly,
+		preAllocate:     r.preAllocate,
+		sizeLimit:       r.sizeLimit,
+	}
+
+	if !r.skeletonOnly {
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		entry.body = bytes.NewReader(body)
+	}
+	if r.digest != nil {
+		entry.digest = sha256.New()
+	}
+
+	return entry, nil
+}
+
+// topLevelDir returns the directory all entries of a tar file are under
+func topLevelDir(fileName string) (string, error) {
+	headers, err := List(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	dir := ""
+
+	for _, header := range headers {
+		name := strings.TrimLeft(path.Clean(header.Name), "/")
+
+		// Entries like `./` are the root itself
+		if name == "." || name == "" {
+			continue
+		}
+
+		first := name
+		if i := strings.Index(name, "/"); i >= 0 {
+			first = name[:i]
+		} else if !header.FileInfo().IsDir() {
+			return "", ErrNoTopLevelDir
+		}
+
+		if dir != "" && first != dir {
+			return "", ErrNoTopLevelDir
+		}
+		dir = first
+	}
+
+	if dir == "" {
+		return "", ErrNoTopLevelDir
+	}
+
+	return dir, nil
+}
+
+// countOccurrences counts how many times each entry is stored in a tar file
+func countOccurrences(fileName string) (map[string]int, error) {
+	headers, err := List(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	occurrences := map[string]int{}
+	for _, header := range headers {
+		occurrences[path.Clean(header.Name)]++
+	}
+
+	return occurrences, nil
+}
+
+// readManifest reads a JSON manifest from disk
+func readManifest(fileName string) (*Manifest, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// unchanged returns true if a file has the same size and either
+// the same mtime or the same SHA-256 as in the manifest. The file is
+// only read when its mtime differs, `entry` gets its SHA-256 if known.
+func (m *Manifest) unchanged(fileName, name string, entry *ManifestEntry) (bool, error) {
+	previous, ok := m.Files[name]
+	if !ok || previous.Size != entry.Size {
+		return false, nil
+	}
+
+	if previous.ModTime.Equal(entry.ModTime) {
+		entry.SHA256 = previous.SHA256
+		return true, nil
+	}
+
+	sum, err := fileChecksum(fileName)
+	if err != nil {
+		return false, err
+	}
+	entry.SHA256 = sum
+
+	return previous.SHA256 == sum, nil
+}
+
+// write writes the manifest as JSON, the files of the base manifest
+// missing in this one are listed as deleted.
+func (m *Manifest) write(fileName string, base *Manifest) error {
+	if base != nil {
+		for name := range base.Files {
+			if _, ok := m.Files[name]; !ok {
+				m.Deleted = append(m.Deleted, name)
+			}
+		}
+		sort.Strings(m.Deleted)
+	}
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fileName, content, 0644)
+}
+
+// verify checks the SHA-256 of a file against the manifest
+func (m *Manifest) verify(name string, sum []byte) error {
+	entry, ok := m.Files[name]
+	if !ok {
+		return fmt.Errorf("File %s is not in the manifest", name)
+	}
+
+	if entry.SHA256 != hex.EncodeToString(sum) {
+		return fmt.Errorf("Checksum mismatch for %s", name)
+	}
+
+	return nil
+}
+
+// Next is just a wrapper aroung tar.Reader.Next
+func (r *tarReader) Next() error {
+	if r.closed {
+		return ErrReaderClosed
+	}
+	header, err := r.reader.Next()
+	r.header = header
+	return err
+}
+
+// Next is just a wrapper aroung tar.Reader.Read
+func (r *tarReader) Read(p []byte) (n int, err error) {
+	if r.closed {
+		return 0, ErrReaderClosed
+	}
+	return r.reader.Read(p)
+}
+
+// corruptError wraps an error reading the tar file with the current
+// position of the file, which is never beyond its end.
+func (r *tarReader) corruptError(lastEntry string, err error) error {
+	offset, _ := r.file.Seek(0, io.SeekCurrent)
+	if info, statErr := r.file.Stat(); statErr == nil && offset > info.Size() {
+		offset = info.Size()
+	}
+
+	return &CorruptError{Offset: offset, LastEntry: lastEntry, Err: err}
+}
+
+// drain reads the compressed stream up to its end, so the decompressor
+// validates its checksum even if the tar file ended earlier.
+func (r *tarReader) drain() error {
+	if r.compressReader == nil {
+		// The padding after the end of the tar file is read as well,
+		// so the progress reaches the size of the file
+		if r.progress != nil {
+			_, err := io.Copy(ioutil.Discard, r.progress)
+			return err
+		}
+		return nil
+	}
+	_, err := io.Copy(ioutil.Discard, r.compressReader)
+	return err
+}
+
+// closeWithError closes the tar file and stores the error of Close
+// into `err` unless it already holds an error.
+func (r *tarReader) closeWithError(err *error) {
+	if cerr := r.Close(); *err == nil {
+		*err = cerr
+	}
+}
+
+// Close closes the tar file.
+func (r *tarReader) Close() error {
+	if r.closed {
+		return ErrReaderClosed
+	}
+	r.closed = true
+
+	if r.compressReader != nil {
+		if err := r.compressReader.Close(); err != nil {
+			return err
+		}
+	}
+
+	// Readers over a stream have no file to close
+	if r.file != nil {
+		if err := r.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the tar file, we usually use remove=true when the tar file
+// is created but the compression fails, in this case
+// we have to delete the tar file.
+// A tar file opened to append is never deleted.
+func (w *tarWriter) Close(remove bool) error {
+	// The file is always closed, even if flushing the writers fails
+	var err error
+
+	if w.checksum != nil && !remove {
+		err = w.writeChecksum()
+	}
+
+	// The end-of-archive marker is kept in a single volume
+	if err == nil && !remove {
+		err = w.reserveVolume(2 * blockSize)
+	}
+
+	if w.writer != nil {
+		if cerr := w.writer.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if w.compressWriter != nil {
+		if cerr := w.compressWriter.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if w.volumes != nil {
+		if cerr := w.volumes.Close(remove); err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	if w.sync && !remove && err == nil {
+		err = syncFile(w.file)
+	}
+
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+
+	// The directory entry of a new tar file is flushed as well
+	if w.sync && !remove && err == nil {
+		err = syncDir(filepath.Dir(w.fileName))
+	}
+
+	if w.index != nil && !remove && err == nil {
+		err = writeIndex(w.fileName+indexExtension, w.index)
+	}
+
+	if remove && !w.append {
+		return os.Remove(w.fileName)
+	}
 
-	if options.Append {
-		file, err = os.OpenFile(fileName, os.O_RDWR, os.ModePerm)
-	} else {
-		file, err = os.Create(fileName)
+	return err
+}
+
+// body returns the writer for the body of the current entry,
+// it feeds the checksum when AppendChecksum is set.
+func (w *tarWriter) body() io.Writer {
+	if w.checksum == nil {
+		return w.writer
 	}
+	return io.MultiWriter(w.writer, w.checksum)
+}
+
+// writeChecksum writes the checksum of all bodies written so far
+// as the last entry.
+func (w *tarWriter) writeChecksum() error {
+	content := hex.EncodeToString(w.checksum.Sum(nil)) + "\n"
+	w.checksum = nil
+	return w.WriteBytes(ChecksumEntryName, []byte(content))
+}
 
+// Write writes a file from disk into a tar file.
+func (w *tarWriter) Write(fileName, name string) error {
+	fileInfo, err := os.Lstat(fileName)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// In case of error we close and remove the tar file
-	// if it was just created (append=false)
-	defer func() {
-		if err != nil {
-			file.Close()
+	// Broken symlinks are kept as symlinks
+	if w.followSymlinks && fileInfo.Mode()&os.ModeSymlink != 0 {
+		if targetInfo, err := os.Stat(fileName); err == nil {
+			fileInfo = targetInfo
+		}
+	}
 
-			if !options.Append {
-				os.Remove(fileName)
+	link := ""
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(fileName); err != nil {
+			return err
+		}
+		if w.linkRoot != "" {
+			if link, err = rewriteLink(fileName, link, w.linkRoot); err != nil {
+				return err
 			}
 		}
-	}()
+	}
 
-	compression := options.Compression
+	header, err := tar.FileInfoHeader(fileInfo, link)
+	if err != nil {
+		return err
+	}
 
-	if options.Append {
-		// Reads the header from the file to see which compression
-		// this file has been using.
-		compression, err := detectCompression(file)
-		if err != nil {
-			return nil, err
+	header.Name = name
+
+	// The file is opened before writing the header, so a file that
+	// cannot be read does not leave an incomplete entry behind
+	var file io.ReadCloser
+	if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+		if file, err = openFile(fileName); err != nil {
+			return err
 		}
+		if w.retry != nil {
+			file = &retryReader{ReadCloser: file, fileName: fileName, retry: w.retry}
+		}
+		defer file.Close()
+	}
 
-		// I have only found this hack to append files into a tar file.
-		// It works only for uncompressed tar files :(
-		// http://stackoverflow.com/questions/18323995/golang-append-file-to-an-existing-tar-archive
-		// We may improve it in the future.
+	if w.preserveCaps && header.Typeflag == tar.TypeReg {
+		capability, err := getCapability(fileName)
+		if err != nil {
+			return err
+		}
+		if capability != nil {
+			header.PAXRecords = map[string]string{paxCapability: string(capability)}
+		}
+	}
 
-		if compression != Uncompressed {
-			return nil, ErrAppendNotSupported
+	if w.dedup != nil && header.Typeflag == tar.TypeReg {
+		sum, err := fileChecksum(fileName)
+		if err != nil {
+			return err
 		}
+		if original, ok := w.dedup[sum]; ok {
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
+			}
+			header.PAXRecords[paxDedup] = original
+			header.Size = 0
+			return w.writeHeader(header)
+		}
+		w.dedup[sum] = name
+	}
 
-		if _, err = file.Seek(-2<<9, os.SEEK_END); err != nil {
-			file.Close()
-			return nil, err
+	if w.proxy != nil && (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA) {
+		if err := w.adaptCompression(fileName); err != nil {
+			return err
 		}
 	}
 
-	var compressWriter io.WriteCloser
+	var src io.Reader = file
+	if file != nil && w.entryTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), w.entryTimeout)
+		defer cancel()
+		src = &contextReader{ctx: ctx, Reader: file}
+	}
 
-	switch compression {
-	case Gzip:
-		compressWriter = gzip.NewWriter(file)
-	case Bzip2:
-		return nil, ErrBzip2NotSupported
+	// The body is compressed upfront as its size goes into the header
+	if file != nil && w.perEntry {
+		compressed, err := compressEntry(header, src)
+		if err == context.DeadlineExceeded {
+			return ErrEntryTimeout
+		}
+		if err != nil {
+			return err
+		}
+		defer os.Remove(compressed.Name())
+		defer compressed.Close()
+		src = compressed
 	}
 
-	var writer *tar.Writer
+	if err := w.writeHeader(header); err != nil {
+		return err
+	}
 
-	if compressWriter == nil {
-		writer = tar.NewWriter(file)
-	} else {
-		writer = tar.NewWriter(compressWriter)
+	if file == nil {
+		return nil
 	}
 
-	return &tarWriter{
-		file:           file,
-		writer:         writer,
-		compressWriter: compressWriter,
-	}, nil
+	_, err = io.Copy(w.body(), src)
+	if err == context.DeadlineExceeded {
+		return ErrEntryTimeout
+	}
+	return err
 }
 
-// detectCompression detects which comperssion the tar file has been using.
-func detectCompression(file *os.File) (Compression, error) {
-	source := make([]byte, 3)
+// compressEntry gzips the body of an entry into a temporary file
+// and updates the header to describe it.
+func compressEntry(header *tar.Header, src io.Reader) (*os.File, error) {
+	file, err := ioutil.TempFile("", "tarx")
+	if err != nil {
+		return nil, err
+	}
 
-	if _, err := file.ReadAt(source, 0); err != nil {
-		return Uncompressed, err
+	gzipWriter := gzip.NewWriter(file)
+	size, err := io.Copy(gzipWriter, src)
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	var compressedSize int64
+	if err == nil {
+		compressedSize, err = file.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
 	}
 
-	for compression, m := range map[Compression][]byte{
-		Bzip2: {0x42, 0x5A, 0x68},
-		Gzip:  {0x1F, 0x8B, 0x08},
-	} {
-		if len(source) < len(m) {
-			continue
+	if header.PAXRecords == nil {
+		header.PAXRecords = map[string]string{}
+	}
+	header.PAXRecords[paxCompression] = "gzip"
+	header.PAXRecords[paxSize] = strconv.FormatInt(size, 10)
+	header.Size = compressedSize
+
+	return file, nil
+}
+
+// entrySize returns the size of the content of a regular file entry,
+// which is not the size of the body for entries written with PerEntryCompression.
+func entrySize(header *tar.Header) int64 {
+	if isEntryCompressed(header) {
+		if size, err := strconv.ParseInt(header.PAXRecords[paxSize], 10, 64); err == nil {
+			return size
 		}
-		if bytes.Compare(m, source[:len(m)]) == 0 {
-			return compression, nil
+	}
+	return header.Size
+}
+
+// openBody returns the content of the current entry of a tar reader,
+// decompressed if the entry was written with PerEntryCompression.
+// Deduplicated entries have the content of their original entry, taken
+// from `kept` if the caller kept it or else read again from the tar file.
+func (r *tarReader) openBody(kept map[string][]byte) (io.ReadCloser, error) {
+	if original, ok := r.header.PAXRecords[paxDedup]; ok {
+		if content, ok := kept[path.Clean(original)]; ok {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
 		}
+		_, original, err := openOriginal(r.fileName, r.header)
+		return original, err
 	}
-	return Uncompressed, nil
+	if isEntryCompressed(r.header) {
+		return gzip.NewReader(r)
+	}
+	return ioutil.NopCloser(r), nil
 }
 
-// Extract extracts a tar file into disk
-func (r *tarReader) Extract(fileName string, noOverride bool) error {
-	fileInfo, err := os.Lstat(fileName)
-	if err != nil && !os.IsNotExist(err) {
-		return err
+// openOriginal reads again from a tar file the header and the content of
+// the entry a deduplicated entry references, the first entry with that name.
+func openOriginal(fileName string, header *tar.Header) (*tar.Header, io.ReadCloser, error) {
+	original := header.PAXRecords[paxDedup]
+
+	// Tar streams cannot be read again
+	if fileName == "" {
+		return nil, nil, fmt.Errorf("Entry %q references %q which cannot be read again", header.Name, original)
 	}
 
-	// If the `fileName` already exists on disk and it is a file
-	// we try to delete it in order to create a new one unless
-	// `noOverride` is set to true
-	if err == nil && !fileInfo.IsDir() {
-		if noOverride {
-			return nil
-		}
+	originalHeader, reader, err := find(fileName, original, false)
+	if err == os.ErrNotExist {
+		return nil, nil, fmt.Errorf("Entry %q references %q which does not exist", header.Name, original)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if err := os.Remove(fileName); err != nil {
-			return err
+	// Originals are never deduplicated, which also prevents cycles
+	if _, ok := originalHeader.PAXRecords[paxDedup]; ok || reader == nil {
+		if reader != nil {
+			reader.Close()
 		}
+		return nil, nil, fmt.Errorf("Entry %q references %q which is not a regular file", header.Name, original)
 	}
 
-	// header.Mode is in linux format, we have to convert it to os.FileMode
-	// to be compatible to other platforms.
-	headerInfo := r.header.FileInfo()
+	return originalHeader, reader, nil
+}
 
-	switch r.header.Typeflag {
-	case tar.TypeDir:
-		if err := os.Mkdir(fileName, headerInfo.Mode()); err != nil && !os.IsExist(err) {
-			return err
-		}
-	case tar.TypeReg, tar.TypeRegA:
-		if err := createFile(fileName, headerInfo.Mode(), r.reader); err != nil {
-			return err
-		}
-	case tar.TypeSymlink:
-		if err := os.Symlink(r.header.Linkname, fileName); err != nil {
-			return err
-		}
-	default:
-		return fmt.Errorf("Unhandled tar header type %d", r.header.Typeflag)
+// isEntryCompressed returns true for the entries written with PerEntryCompression
+func isEntryCompressed(header *tar.Header) bool {
+	return header.PAXRecords[paxCompression] == "gzip"
+}
+
+// adaptCompression samples the beginning of a file and, if its
+// compressibility differs from the current gzip level, finishes the current
+// gzip member and starts a new one with the appropriate level.
+func (w *tarWriter) adaptCompression(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+
+	sample := make([]byte, adaptiveSampleSize)
+	n, err := io.ReadFull(file, sample)
+	file.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	level := gzip.DefaultCompression
+	if entropy(sample[:n]) > incompressibleEntropy {
+		level = gzip.NoCompression
+	}
+
+	if level == w.level {
+		return nil
+	}
+
+	// Writes the padding of the previous entry into the current member
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+
+	if err := w.compressWriter.Close(); err != nil {
+		return err
+	}
+
+	compressWriter, err := gzip.NewWriterLevel(w.output, level)
+	if err != nil {
+		return err
 	}
 
+	w.compressWriter = compressWriter
+	w.proxy.Writer = compressWriter
+	w.level = level
+
 	return nil
 }
 
-// Next is just a wrapper aroung tar.Reader.Next
-func (r *tarReader) Next() error {
-	header, err := r.reader.Next()
-	r.header = header
-	return err
-}
+// reserveVolume starts a new volume unless the current one has room for
+// `size` more bytes, so entries are not split across volumes when they fit.
+// The size of compressed entries is unknown, they are split anywhere.
+func (w *tarWriter) reserveVolume(size int64) error {
+	if w.volumes == nil || w.compressWriter != nil {
+		return nil
+	}
 
-// Next is just a wrapper aroung tar.Reader.Read
-func (r *tarReader) Read(p []byte) (n int, err error) {
-	return r.reader.Read(p)
+	// Writes the padding of the previous entry into the current volume
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+
+	return w.volumes.reserve(size)
 }
 
-// Close closes the tar file.
-func (r *tarReader) Close() error {
-	if r.compressReader != nil {
-		if err := r.compressReader.Close(); err != nil {
+// writeHeader writes a header in the format of the options, if any.
+func (w *tarWriter) writeHeader(header *tar.Header) error {
+	if err := w.reserveVolume(blockSize + (header.Size+blockSize-1)&^(blockSize-1)); err != nil {
+		return err
+	}
+
+	if w.format == tar.FormatUnknown {
+		if err := w.writer.WriteHeader(header); err != nil {
 			return err
 		}
+		return w.addIndex(header)
+	}
+
+	header.Format = w.format
+
+	// Only PAX holds sub-second times and only PAX and GNU hold atime and ctime
+	if w.format != tar.FormatPAX {
+		header.ModTime = header.ModTime.Truncate(time.Second)
+		header.AccessTime = header.AccessTime.Truncate(time.Second)
+		header.ChangeTime = header.ChangeTime.Truncate(time.Second)
+	}
+	if w.format == tar.FormatUSTAR {
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+	}
+
+	if err := w.writer.WriteHeader(header); err != nil {
+		return fmt.Errorf("Entry %s cannot be written in the %v format: %v", header.Name, w.format, err)
+	}
+
+	return w.addIndex(header)
+}
+
+// addIndex records the offset of the body of an entry whose header was
+// just written, tar.Writer writes the header straight to the file.
+func (w *tarWriter) addIndex(header *tar.Header) error {
+	if w.index == nil {
+		return nil
 	}
 
-	if err := r.file.Close(); err != nil {
+	offset, err := w.file.Seek(0, io.SeekCurrent)
+	if err != nil {
 		return err
 	}
 
+	w.index = append(w.index, IndexEntry{
+		Name:       path.Clean(header.Name),
+		Offset:     offset,
+		Size:       header.Size,
+		Compressed: isEntryCompressed(header),
+		Dedup:      header.PAXRecords[paxDedup],
+	})
 	return nil
 }
 
-// Close closes the tar file, we usually use remove=true when the tar file
-// is created but the compression fails, in this case
-// we have to delete the tar file.
-func (w *tarWriter) Close(remove bool) error {
-	if w.writer != nil {
-		if err := w.writer.Close(); err != nil {
-			return err
-		}
+// WriteEntry writes an entry with its own header into a tar file.
+func (w *tarWriter) WriteEntry(entry EntrySpec) error {
+	if entry.Header == nil {
+		return errors.New("Entry without header")
 	}
 
-	if w.compressWriter != nil {
-		if err := w.compressWriter.Close(); err != nil {
-			return err
-		}
+	if entry.Body == nil && entry.Header.Size > 0 {
+		return fmt.Errorf("Entry %s has no body but its size is %d", entry.Header.Name, entry.Header.Size)
 	}
 
-	if err := w.file.Close(); err != nil {
+	if err := w.writeHeader(entry.Header); err != nil {
 		return err
 	}
 
-	if remove {
-		return os.Remove(w.fileName)
+	if entry.Body == nil {
+		return nil
+	}
+
+	n, err := io.Copy(w.body(), entry.Body)
+	if err == tar.ErrWriteTooLong {
+		return fmt.Errorf("Entry %s has more than %d bytes", entry.Header.Name, entry.Header.Size)
+	}
+	if err != nil {
+		return err
+	}
+
+	if n != entry.Header.Size {
+		return fmt.Errorf("Entry %s has %d bytes but its size is %d", entry.Header.Name, n, entry.Header.Size)
 	}
 
 	return nil
 }
 
-// Write writes a file from disk into a tar file.
-func (w *tarWriter) Write(fileName, name string) error {
-	fileInfo, err := os.Lstat(fileName)
-	if err != nil {
+// WriteBytes writes a regular file from memory into a tar file.
+func (w *tarWriter) WriteBytes(name string, data []byte) error {
+	header := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	}
+
+	if err := w.writeHeader(header); err != nil {
 		return err
 	}
 
-	link := ""
-	if fileInfo.Mode()&os.ModeSymlink != 0 {
-		if link, err = os.Readlink(fileName); err != nil {
-			return err
-		}
+	_, err := w.body().Write(data)
+	return err
+}
+
+// WriteDumpDir writes a directory from disk as a GNU incremental entry,
+// `content` is the listing of the directory.
+func (w *tarWriter) WriteDumpDir(fileName, name string, content []byte) error {
+	fileInfo, err := os.Lstat(fileName)
+	if err != nil {
+		return err
 	}
 
-	header, err := tar.FileInfoHeader(fileInfo, link)
+	header, err := tar.FileInfoHeader(fileInfo, "")
 	if err != nil {
 		return err
 	}
 
 	header.Name = name
+	header.Typeflag = typeGNUDumpDir
+	header.Size = int64(len(content))
+	header.Format = tar.FormatGNU
 
-	if err := w.writer.WriteHeader(header); err != nil {
+	if err := w.reserveVolume(blockSize + (header.Size+blockSize-1)&^(blockSize-1)); err != nil {
 		return err
 	}
 
-	if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
-		return nil
+	if err := w.writer.WriteHeader(header); err != nil {
+		return err
 	}
 
-	file, err := os.Open(fileName)
-	if err != nil {
+	if err := w.addIndex(header); err != nil {
 		return err
 	}
 
-	defer file.Close()
-
-	_, err = io.Copy(w.writer, file)
+	_, err = w.body().Write(content)
 	return err
 }
@@ -0,0 +1,94 @@
+package tarx
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractWithMergeAppleDouble(t *testing.T) {
+	filename := "tests/test.tar"
+
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "._a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 141}, Body: bytes.NewReader(appleDouble("com.tarx.test", "value"))},
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, Body: strings.NewReader("a.txt")},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{MergeAppleDouble: true})
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOTSUP {
+		t.Skip("extended attributes are not supported:", err)
+	}
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/output/._a.txt"))
+	assert.Equal(t, "value", getxattr("tests/output/a.txt", "com.tarx.test"))
+}
+
+func TestExtractWithMergeAppleDoubleTraversal(t *testing.T) {
+	filename := "tests/test.tar"
+
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "../._a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 141}, Body: bytes.NewReader(appleDouble("com.tarx.test", "value"))},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{MergeAppleDouble: true})
+	assert.Equal(t, ErrPathTraversal, err)
+	defer os.RemoveAll("tests/output")
+}
+
+// appleDouble builds an AppleDouble file holding a single extended attribute
+func appleDouble(name, value string) []byte {
+	data := make([]byte, 136, 141)
+	binary.BigEndian.PutUint32(data[0:], 0x00051607)
+	binary.BigEndian.PutUint32(data[4:], 0x00020000)
+	binary.BigEndian.PutUint16(data[24:], 1)
+
+	// Finder info entry followed by the extended attributes
+	binary.BigEndian.PutUint32(data[26:], 9)
+	binary.BigEndian.PutUint32(data[30:], 38)
+	binary.BigEndian.PutUint32(data[34:], 103)
+
+	copy(data[72:], "ATTR")
+	binary.BigEndian.PutUint32(data[80:], 141)
+	binary.BigEndian.PutUint32(data[84:], 136)
+	binary.BigEndian.PutUint32(data[88:], uint32(len(value)))
+	binary.BigEndian.PutUint16(data[106:], 1)
+
+	binary.BigEndian.PutUint32(data[108:], 136)
+	binary.BigEndian.PutUint32(data[112:], uint32(len(value)))
+	data[118] = byte(len(name) + 1)
+	copy(data[119:], name)
+
+	return append(data, value...)
+}
+
+func getxattr(fileName, name string) string {
+	fileNamePtr, _ := syscall.BytePtrFromString(fileName)
+	namePtr, _ := syscall.BytePtrFromString(name)
+	value := make([]byte, 256)
+	n, _, errno := syscall.Syscall6(syscall.SYS_GETXATTR,
+		uintptr(unsafe.Pointer(fileNamePtr)),
+		uintptr(unsafe.Pointer(namePtr)),
+		uintptr(unsafe.Pointer(&value[0])),
+		uintptr(len(value)),
+		0,
+		0)
+	if errno != 0 {
+		return ""
+	}
+	return string(value[:n])
+}
@@ -0,0 +1,290 @@
+package tarx
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractWithPreserveCaps(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/caps", os.ModePerm)
+	defer os.RemoveAll("tests/caps")
+	writeContent("tests/caps/bin", "bin")
+
+	// VFS_CAP_REVISION_2 with CAP_NET_BIND_SERVICE effective and permitted
+	capability := []byte{0x01, 0x00, 0x00, 0x02, 0x00, 0x04, 0x00, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if err := setCapability("tests/caps/bin", capability); err != nil {
+		t.Skip("setting file capabilities is not permitted:", err)
+	}
+
+	err := Compress(filename, "tests/caps", &CompressOptions{PreserveCaps: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{PreserveCaps: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	value := make([]byte, 64)
+	n, err := syscall.Getxattr("tests/output/bin", capabilityXattr, value)
+	assert.NoError(t, err)
+	assert.Equal(t, capability, value[:n])
+}
+
+func TestExtractWithPreserveAccessTime(t *testing.T) {
+	filename := "tests/test.tar"
+
+	mtime := time.Date(2015, 12, 5, 10, 0, 0, 0, time.UTC)
+	atime := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	header := &tar.Header{
+		Name:       "a.txt",
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		ModTime:    mtime,
+		AccessTime: atime,
+		Format:     tar.FormatPAX,
+	}
+	writeTar(filename, header, "a.txt")
+	defer os.Remove(filename)
+
+	err := Extract(filename, "tests/output", &ExtractOptions{PreserveAccessTime: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	info, _ := os.Stat("tests/output/a.txt")
+	stat := info.Sys().(*syscall.Stat_t)
+	assert.Equal(t, mtime, info.ModTime().UTC())
+	assert.Equal(t, atime, time.Unix(stat.Atim.Unix()).UTC())
+}
+
+func TestExtractSandboxed(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = ExtractSandboxed(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "a.txt\n", readContent("tests/output/a.txt"))
+	assert.Equal(t, "f1.txt\n", readContent("tests/output/c/c1.txt"))
+
+	link, err := os.Readlink("tests/output/symlink.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", link)
+}
+
+func TestExtractSandboxedWithPerEntryCompression(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{PerEntryCompression: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = ExtractSandboxed(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "a.txt\n", readContent("tests/output/a.txt"))
+	assert.Equal(t, "f1.txt\n", readContent("tests/output/c/c1.txt"))
+}
+
+func TestExtractSandboxedWithDedup(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/dedup", os.ModePerm)
+	defer os.RemoveAll("tests/dedup")
+	writeContent("tests/dedup/a.txt", "same")
+	writeContent("tests/dedup/b.txt", "same")
+
+	err := Compress(filename, "tests/dedup", &CompressOptions{Dedup: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = ExtractSandboxed(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "same", readContent("tests/output/a.txt"))
+	assert.Equal(t, "same", readContent("tests/output/b.txt"))
+}
+
+func TestExtractSandboxedThroughSymlink(t *testing.T) {
+	filename := "tests/test.tar"
+
+	// The symlink is extracted first and the file is written through it
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+		{Header: &tar.Header{Name: "c/c1.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 6}, Body: strings.NewReader("c1.txt")},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	os.MkdirAll("tests/outside", os.ModePerm)
+	defer os.RemoveAll("tests/outside")
+
+	err = ExtractSandboxed(filename, "tests/output", nil)
+	assert.Equal(t, ErrSymlinkInPath, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/outside/c1.txt"))
+}
+
+func TestExtractSandboxedWithInvalidName(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeTar(filename, &tar.Header{Name: "a\x1b.txt", Typeflag: tar.TypeReg, Mode: 0644}, "a.txt")
+	defer os.Remove(filename)
+	defer os.RemoveAll("tests/output")
+
+	err := ExtractSandboxed(filename, "tests/output", nil)
+	assert.Error(t, err)
+	assert.Equal(t, false, pathExists("tests/output/a\x1b.txt"))
+
+	err = ExtractSandboxed(filename, "tests/output", &ExtractOptions{SanitizeNames: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", readContent("tests/output/a_.txt"))
+}
+
+func TestExtractSandboxedWithUnsupportedOption(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = ExtractSandboxed(filename, "tests/output", &ExtractOptions{MaxTotalSize: 1})
+	assert.EqualError(t, err, "Option MaxTotalSize is not supported by ExtractSandboxed")
+	assert.Equal(t, false, pathExists("tests/output"))
+
+	err = ExtractSandboxed(filename, "tests/output", &ExtractOptions{Filters: []string{"a.txt"}, NoOverride: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+	assert.Equal(t, "a.txt\n", readContent("tests/output/a.txt"))
+}
+
+func TestExtractWithPreserveDevices(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/devices", os.ModePerm)
+	defer os.RemoveAll("tests/devices")
+	err := syscall.Mkfifo("tests/devices/fifo", 0640)
+	assert.NoError(t, err)
+
+	err = Compress(filename, "tests/devices", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.Error(t, err)
+	defer os.RemoveAll("tests/output")
+
+	err = Extract(filename, "tests/output", &ExtractOptions{PreserveDevices: true})
+	assert.NoError(t, err)
+
+	info, err := os.Lstat("tests/output/fifo")
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeNamedPipe|0640, info.Mode())
+
+	// /dev/null is the character device 1:3
+	err = Compress(filename, "/dev/null", nil)
+	assert.NoError(t, err)
+
+	header, err := Stat(filename, "null")
+	assert.NoError(t, err)
+	assert.Equal(t, byte(tar.TypeChar), header.Typeflag)
+	assert.Equal(t, int64(1), header.Devmajor)
+	assert.Equal(t, int64(3), header.Devminor)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{PreserveDevices: true})
+	if os.IsPermission(err) {
+		t.Skip("creating devices is not permitted:", err)
+	}
+	assert.NoError(t, err)
+
+	info, err = os.Lstat("tests/output/null")
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeDevice|os.ModeCharDevice, info.Mode().Type())
+	assert.Equal(t, uint64(mkdev(1, 3)), info.Sys().(*syscall.Stat_t).Rdev)
+}
+
+func TestExtractWithPreserveTimesOnSymlink(t *testing.T) {
+	filename := "tests/test.tar"
+
+	fileTime := time.Date(2015, 12, 5, 10, 0, 0, 0, time.UTC)
+	linkTime := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: fileTime}, Body: strings.NewReader("a.txt")},
+		{Header: &tar.Header{Name: "link.txt", Typeflag: tar.TypeSymlink, Linkname: "a.txt", ModTime: linkTime}},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{PreserveTimes: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	info, err := os.Lstat("tests/output/link.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, linkTime, info.ModTime().UTC())
+
+	info, err = os.Stat("tests/output/link.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, fileTime, info.ModTime().UTC())
+}
+
+func TestExtractWithPreAllocate(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{PerEntryCompression: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	sizes := map[string]int64{}
+	original := fallocate
+	defer func() { fallocate = original }()
+	fallocate = func(file *os.File, size int64) error {
+		sizes[filepath.Base(file.Name())] = size
+		return original(file, size)
+	}
+
+	err = Extract(filename, "tests/output", &ExtractOptions{PreAllocate: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, map[string]int64{"a.txt": 6, "b.txt": 6, "c1.txt": 7, "c2.txt": 7}, sizes)
+
+	info, err := os.Stat("tests/output/c/c1.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size())
+	assert.Equal(t, "f1.txt\n", readContent("tests/output/c/c1.txt"))
+}
+
+func TestExtractWithPreAllocateEmptyFile(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeTar(filename, &tar.Header{Name: "empty.txt", Typeflag: tar.TypeReg, Mode: 0644}, "")
+	defer os.Remove(filename)
+
+	err := Extract(filename, "tests/output", &ExtractOptions{PreAllocate: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	info, err := os.Stat("tests/output/empty.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
@@ -1,9 +1,24 @@
 package tarx
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -61,130 +76,2933 @@ func TestCompressFolderWithIncludeSourceDir(t *testing.T) {
 	assert.Equal(t, "input/symlink.txt", headers[6].Name)
 }
 
+func TestCompressWithRewriteSymlinks(t *testing.T) {
+	filename := "tests/test.tar"
+
+	srcDir, err := ioutil.TempDir("", "tarx")
+	assert.NoError(t, err)
+	defer os.RemoveAll(srcDir)
+
+	writeContent(srcDir+"/a.txt", "a.txt")
+	os.Mkdir(srcDir+"/d", os.ModePerm)
+	assert.NoError(t, os.Symlink(srcDir+"/a.txt", srcDir+"/d/link.txt"))
+	assert.NoError(t, os.Symlink("/etc/hosts", srcDir+"/hosts"))
+
+	err = Compress(filename, srcDir, &CompressOptions{IncludeSourceDir: true, RewriteSymlinks: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	root := "tests/output/" + filepath.Base(srcDir)
+
+	link, _ := os.Readlink(root + "/d/link.txt")
+	assert.Equal(t, "../a.txt", link)
+	assert.Equal(t, "a.txt", readContent(root+"/d/link.txt"))
+
+	link, _ = os.Readlink(root + "/hosts")
+	assert.Equal(t, "/etc/hosts", link)
+}
+
+func TestCompressWithAdaptiveCompression(t *testing.T) {
+	filename := "tests/test.tar.gz"
+
+	os.MkdirAll("tests/mixed", os.ModePerm)
+	defer os.RemoveAll("tests/mixed")
+	writeMixedCorpus("tests/mixed", 2, 64<<10)
+
+	err := Compress(filename, "tests/mixed", &CompressOptions{Compression: Gzip, AdaptiveCompression: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(headers))
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	for _, name := range []string{"0.bin", "0.txt", "1.bin", "1.txt"} {
+		expected, _ := ioutil.ReadFile("tests/mixed/" + name)
+		actual, _ := ioutil.ReadFile("tests/output/" + name)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestCompressWithEntryTimeout(t *testing.T) {
+	filename := "tests/test.tar"
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	defer func(f func(string) (io.ReadCloser, error)) { openFile = f }(openFile)
+	openFile = func(fileName string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(&blockingReader{unblock}), nil
+	}
+
+	err := Compress(filename, "tests/input/a.txt", &CompressOptions{EntryTimeout: 10 * time.Millisecond})
+	assert.Equal(t, ErrEntryTimeout, err)
+	assert.Equal(t, false, pathExists(filename))
+}
+
+func TestCompressSkipsFilteredDirs(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/tree/node_modules/pkg", os.ModePerm)
+	os.MkdirAll("tests/tree/src", os.ModePerm)
+	defer os.RemoveAll("tests/tree")
+	writeContent("tests/tree/node_modules/pkg/index.js", "index.js")
+	writeContent("tests/tree/src/main.go", "main.go")
+
+	walked := []string{}
+	defer func(f func(string, filepath.WalkFunc) error) { walk = f }(walk)
+	walk = func(root string, fn filepath.WalkFunc) error {
+		return filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+			walked = append(walked, filepath.ToSlash(filePath))
+			return fn(filePath, info, err)
+		})
+	}
+
+	err := Compress(filename, "tests/tree", &CompressOptions{Filters: []string{"src", "!node_modules"}})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	assert.Equal(t, []string{"tests/tree", "tests/tree/node_modules", "tests/tree/src", "tests/tree/src/main.go"}, walked)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(headers))
+}
+
+func TestCompressWithRetryFunc(t *testing.T) {
+	filename := "tests/test.tar"
+
+	// The first read of c1.txt fails after 3 bytes
+	failed := false
+	defer func(f func(string) (io.ReadCloser, error)) { openFile = f }(openFile)
+	openFile = func(fileName string) (io.ReadCloser, error) {
+		if !failed && filepath.Base(fileName) == "c1.txt" {
+			failed = true
+			return ioutil.NopCloser(&failingReader{strings.NewReader("f1."), io.ErrUnexpectedEOF}), nil
+		}
+		return os.Open(fileName)
+	}
+
+	attempts := []int{}
+	retry := func(fileName string, attempt int, err error) bool {
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+		attempts = append(attempts, attempt)
+		return true
+	}
+
+	err := Compress(filename, "tests/input", &CompressOptions{RetryFunc: retry})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	assert.Equal(t, []int{1}, attempts)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "f1.txt\n", readContent("tests/output/c/c1.txt"))
+
+	// Without retrying the error is returned
+	failed = false
+	err = Compress(filename, "tests/input", nil)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestCompressWithCheckpoint(t *testing.T) {
+	filename := "tests/test.tar"
+	checkpoint := "tests/checkpoint"
+
+	defer os.Remove(filename)
+	defer os.Remove(checkpoint)
+
+	// Simulates an interruption when c1.txt is reached
+	interrupt := true
+	defer func(f func(string) (io.ReadCloser, error)) { openFile = f }(openFile)
+	openFile = func(fileName string) (io.ReadCloser, error) {
+		if interrupt && filepath.Base(fileName) == "c1.txt" {
+			return nil, os.ErrPermission
+		}
+		return os.Open(fileName)
+	}
+
+	options := &CompressOptions{Checkpoint: checkpoint}
+	err := Compress(filename, "tests/input", options)
+	assert.Equal(t, os.ErrPermission, err)
+	assert.Equal(t, true, pathExists(checkpoint))
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(headers))
+
+	interrupt = false
+	err = Compress(filename, "tests/input", options)
+	assert.Equal(t, ErrResumeWithoutAppend, err)
+
+	headers, err = List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(headers))
+
+	options.Append = true
+	err = Compress(filename, "tests/input", options)
+	assert.NoError(t, err)
+	assert.Equal(t, false, pathExists(checkpoint))
+
+	headers, err = List(filename)
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, header := range headers {
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{"a.txt", "b.txt", "c", "c/c1.txt", "c/c2.txt", "symlink.txt"}, names)
+}
+
+func TestCompressWithCheckpointCompressed(t *testing.T) {
+	filename := "tests/test.tar.gz"
+	checkpoint := "tests/checkpoint"
+
+	err := Compress(filename, "tests/input", &CompressOptions{Compression: Gzip, Checkpoint: checkpoint})
+	assert.Equal(t, ErrCheckpointCompressed, err)
+	assert.Equal(t, false, pathExists(filename))
+	assert.Equal(t, false, pathExists(checkpoint))
+}
+
+func TestCompressWithCheckpointAfterKill(t *testing.T) {
+	filename := "tests/test.tar"
+	checkpoint := "tests/checkpoint"
+
+	defer os.Remove(filename)
+	defer os.Remove(checkpoint)
+
+	interrupt := true
+	defer func(f func(string) (io.ReadCloser, error)) { openFile = f }(openFile)
+	openFile = func(fileName string) (io.ReadCloser, error) {
+		if interrupt && filepath.Base(fileName) == "c1.txt" {
+			return nil, os.ErrPermission
+		}
+		return os.Open(fileName)
+	}
+
+	options := &CompressOptions{Checkpoint: checkpoint}
+	err := Compress(filename, "tests/input", options)
+	assert.Equal(t, os.ErrPermission, err)
+
+	// A process killed while writing c1.txt leaves its header and part
+	// of its body, without the end-of-archive marker
+	content, _ := ioutil.ReadFile(filename)
+	content = content[:len(content)-1024]
+	buf := &bytes.Buffer{}
+	writer := tar.NewWriter(buf)
+	writer.WriteHeader(&tar.Header{Name: "c/c1.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 7})
+	writer.Write([]byte("f1."))
+	ioutil.WriteFile(filename, append(content, buf.Bytes()...), 0644)
+
+	_, err = List(filename)
+	assert.Error(t, err)
+
+	err = Compress(filename, "tests/input", &CompressOptions{Append: true})
+	assert.Error(t, err)
+
+	interrupt = false
+	options.Append = true
+	err = Compress(filename, "tests/input", options)
+	assert.NoError(t, err)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, header := range headers {
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{"a.txt", "b.txt", "c", "c/c1.txt", "c/c2.txt", "symlink.txt"}, names)
+
+	content, err = ReadFile(filename, "c/c1.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "f1.txt\n", string(content))
+}
+
+func TestCompressWithFormat(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{Format: tar.FormatUSTAR})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	for _, header := range headers {
+		assert.Equal(t, tar.FormatUSTAR, header.Format)
+	}
+
+	// Names over 100 characters are only held if they can be split
+	// into the prefix and name fields
+	os.MkdirAll("tests/ustar", os.ModePerm)
+	defer os.RemoveAll("tests/ustar")
+	writeContent("tests/ustar/"+strings.Repeat("a", 120), "a")
+
+	err = Compress(filename, "tests/ustar", &CompressOptions{Format: tar.FormatUSTAR})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "USTAR")
+}
+
+func TestCompressWithBaseManifest(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/base", os.ModePerm)
+	defer os.RemoveAll("tests/base")
+	writeContent("tests/base/a.txt", "a.txt")
+	writeContent("tests/base/b.txt", "b.txt")
+	writeContent("tests/base/c.txt", "c.txt")
+
+	err := Compress(filename, "tests/base", &CompressOptions{WriteManifest: "tests/base.json"})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+	defer os.Remove("tests/base.json")
+
+	writeContent("tests/base/b.txt", "b.txt changed")
+	os.Remove("tests/base/c.txt")
+
+	options := &CompressOptions{BaseManifest: "tests/base.json", WriteManifest: "tests/changes.json"}
+	err = Compress(filename, "tests/base", options)
+	assert.NoError(t, err)
+	defer os.Remove("tests/changes.json")
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(headers))
+	assert.Equal(t, "b.txt", headers[0].Name)
+
+	manifest, err := readManifest("tests/changes.json")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(manifest.Files))
+	assert.Equal(t, int64(13), manifest.Files["b.txt"].Size)
+	assert.Equal(t, []string{"c.txt"}, manifest.Deleted)
+}
+
+func TestCompressWithBaseManifestReadsChangedFiles(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/base", os.ModePerm)
+	defer os.RemoveAll("tests/base")
+	writeContent("tests/base/a.txt", "a.txt")
+	writeContent("tests/base/b.txt", "b.txt")
+	writeContent("tests/base/c.txt", "c.txt")
+
+	err := Compress(filename, "tests/base", &CompressOptions{WriteManifest: "tests/base.json"})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+	defer os.Remove("tests/base.json")
+
+	read := []string{}
+	defer func(f func(string) (string, error)) { fileChecksum = f }(fileChecksum)
+	original := fileChecksum
+	fileChecksum = func(fileName string) (string, error) {
+		read = append(read, filepath.Base(fileName))
+		return original(fileName)
+	}
+
+	// b.txt is touched and c.txt has a new size
+	mtime := time.Now().Add(time.Hour)
+	os.Chtimes("tests/base/b.txt", mtime, mtime)
+	writeContent("tests/base/c.txt", "c.txt changed")
+
+	err = Compress(filename, "tests/base", &CompressOptions{BaseManifest: "tests/base.json"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.txt"}, read)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(headers))
+	assert.Equal(t, "c.txt", headers[0].Name)
+
+	// The new manifest needs the digests of the changed files only
+	read = read[:0]
+	err = Compress(filename, "tests/base", &CompressOptions{BaseManifest: "tests/base.json", WriteManifest: "tests/changes.json"})
+	assert.NoError(t, err)
+	defer os.Remove("tests/changes.json")
+	assert.Equal(t, []string{"b.txt", "c.txt"}, read)
+
+	base, _ := readManifest("tests/base.json")
+	manifest, err := readManifest("tests/changes.json")
+	assert.NoError(t, err)
+	assert.Equal(t, base.Files["a.txt"].SHA256, manifest.Files["a.txt"].SHA256)
+	assert.NotEqual(t, base.Files["c.txt"].SHA256, manifest.Files["c.txt"].SHA256)
+}
+
+func TestCompressWithGitignoreAware(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/git/.git", os.ModePerm)
+	os.MkdirAll("tests/git/build", os.ModePerm)
+	os.MkdirAll("tests/git/sub/build", os.ModePerm)
+	defer os.RemoveAll("tests/git")
+	writeContent("tests/git/.gitignore", "build/\n*.log\n!keep.log\n")
+	writeContent("tests/git/.git/HEAD", "HEAD")
+	writeContent("tests/git/a.txt", "a.txt")
+	writeContent("tests/git/x.log", "x.log")
+	writeContent("tests/git/keep.log", "keep.log")
+	writeContent("tests/git/build/out.bin", "out.bin")
+	writeContent("tests/git/sub/.gitignore", "/b.txt\n")
+	writeContent("tests/git/sub/b.txt", "b.txt")
+	writeContent("tests/git/sub/c.txt", "c.txt")
+	writeContent("tests/git/sub/build/y.txt", "y.txt")
+
+	err := Compress(filename, "tests/git", &CompressOptions{GitignoreAware: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, header := range headers {
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{".gitignore", "a.txt", "keep.log", "sub", "sub/.gitignore", "sub/c.txt"}, names)
+}
+
+func TestCompressOrder(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/order/c", os.ModePerm)
+	os.MkdirAll("tests/order/d/e", os.ModePerm)
+	defer os.RemoveAll("tests/order")
+	writeContent("tests/order/d/e/f.txt", "f.txt")
+	writeContent("tests/order/c.txt", "c.txt")
+	writeContent("tests/order/c/x.txt", "x.txt")
+	writeContent("tests/order/b.txt", "b.txt")
+
+	err := Compress(filename, "tests/order", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, header := range headers {
+		name := path.Clean(header.Name)
+		if dir := path.Dir(name); dir != "." {
+			assert.True(t, seen[dir], "%s is before its directory", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"b.txt", "c", "c/x.txt", "c.txt", "d", "d/e", "d/e/f.txt"}, names)
+}
+
+func TestCompressGzip(t *testing.T) {
+	filename := "tests/test.tar.gz"
+
+	err := CompressGzip(filename, "tests/input")
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	format, err := DetectFormat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, FormatTarGzip, format)
+
+	err = ExtractGzip(filename, "tests/output")
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "a.txt\n", readContent("tests/output/a.txt"))
+	assert.Equal(t, "f1.txt\n", readContent("tests/output/c/c1.txt"))
+}
+
+func TestExtractWithMaxDepth(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeTar(filename, &tar.Header{Name: "a/b/c/d/e.txt", Typeflag: tar.TypeReg, Mode: 0644}, "")
+	defer os.Remove(filename)
+
+	err := Extract(filename, "tests/output", &ExtractOptions{MaxDepth: 4})
+	assert.Equal(t, ErrDepthLimitExceeded, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/output/a/b/c/d/e.txt"))
+
+	err = Extract(filename, "tests/output", &ExtractOptions{MaxDepth: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, true, pathExists("tests/output/a/b/c/d/e.txt"))
+}
+
+func TestContentHash(t *testing.T) {
+	filename1 := "tests/test1.tar"
+	filename2 := "tests/test2.tar.gz"
+
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: time.Unix(1, 0)}, Body: strings.NewReader("a.txt")},
+		{Header: &tar.Header{Name: "b.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: time.Unix(1, 0)}, Body: strings.NewReader("b.txt")},
+	}
+	err := WriteEntries(filename1, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename1)
+
+	entries = []EntrySpec{
+		{Header: &tar.Header{Name: "b.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: time.Unix(2, 0)}, Body: strings.NewReader("b.txt")},
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: time.Unix(2, 0)}, Body: strings.NewReader("a.txt")},
+	}
+	err = WriteEntries(filename2, entries, &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename2)
+
+	hash1, err := ContentHash(filename1)
+	assert.NoError(t, err)
+	hash2, err := ContentHash(filename2)
+	assert.NoError(t, err)
+	assert.Equal(t, hash1, hash2)
+
+	entries[0].Header.Mode = 0600
+	entries[0].Body = strings.NewReader("b.txt")
+	entries[1].Body = strings.NewReader("a.txt")
+	err = WriteEntries(filename2, entries, &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+
+	hash2, err = ContentHash(filename2)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash1, hash2)
+}
+
+func TestContentHashWithDedupAndPerEntry(t *testing.T) {
+	filename1 := "tests/test1.tar"
+	filename2 := "tests/test2.tar"
+
+	os.MkdirAll("tests/dedup", os.ModePerm)
+	defer os.RemoveAll("tests/dedup")
+	writeContent("tests/dedup/a.txt", "same")
+	writeContent("tests/dedup/b.txt", "same")
+
+	err := Compress(filename1, "tests/dedup", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename1)
+
+	err = Compress(filename2, "tests/dedup", &CompressOptions{Dedup: true, PerEntryCompression: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename2)
+
+	hash1, err := ContentHash(filename1)
+	assert.NoError(t, err)
+	hash2, err := ContentHash(filename2)
+	assert.NoError(t, err)
+	assert.Equal(t, hash1, hash2)
+
+	result, err := Diff(filename2, "tests/dedup")
+	assert.NoError(t, err)
+	assert.Equal(t, &DiffResult{Missing: []string{}, Extra: []string{}, Changed: []string{}}, result)
+}
+
+func TestCompressWithSkipEmptyDirs(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/tree/d", os.ModePerm)
+	os.MkdirAll("tests/tree/e/f", os.ModePerm)
+	defer os.RemoveAll("tests/tree")
+	writeContent("tests/tree/a.txt", "a.txt")
+	writeContent("tests/tree/e/f/g.txt", "g.txt")
+	writeContent("tests/tree/e/h.txt", "h.txt")
+
+	names := func() []string {
+		headers, err := List(filename)
+		assert.NoError(t, err)
+
+		names := []string{}
+		for _, header := range headers {
+			names = append(names, header.Name)
+		}
+		return names
+	}
+
+	err := Compress(filename, "tests/tree", &CompressOptions{SkipEmptyDirs: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	assert.Equal(t, []string{"a.txt", "e", "e/f", "e/f/g.txt", "e/h.txt"}, names())
+
+	err = Compress(filename, "tests/tree", &CompressOptions{SkipEmptyDirs: true, Filters: []string{"d", "e/h.txt"}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"e", "e/h.txt"}, names())
+}
+
+func TestCompressWithPerEntryCompression(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{PerEntryCompression: true, WriteIndex: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+	defer os.Remove(filename + ".idx")
+
+	header, err := Stat(filename, "c/c1.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip", header.PAXRecords["TARX.compression"])
+	assert.Equal(t, "7", header.PAXRecords["TARX.size"])
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "a.txt\n", readContent("tests/output/a.txt"))
+	assert.Equal(t, "f1.txt\n", readContent("tests/output/c/c1.txt"))
+
+	// Entries are read on their own, the corrupted a.txt is never decompressed
+	index, err := Index(filename)
+	assert.NoError(t, err)
+	file, _ := os.OpenFile(filename, os.O_WRONLY, 0)
+	file.WriteAt([]byte{0}, index[0].Offset)
+	file.Close()
+
+	reader, err := OpenWithIndex(filename, "c/c1.txt")
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	reader.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "f1.txt\n", string(content))
+
+	_, err = OpenWithIndex(filename, "a.txt")
+	assert.Error(t, err)
+
+	err = Compress("tests/test.tar.gz", "tests/input", &CompressOptions{Compression: Gzip, PerEntryCompression: true})
+	assert.Equal(t, ErrPerEntryNotSupported, err)
+}
+
+func TestOpenAt(t *testing.T) {
+	for _, compression := range []Compression{Uncompressed, Gzip} {
+		filename := "tests/test.tar"
+		bundle := "tests/bundle.bin"
+
+		err := Compress(filename, "tests/input", &CompressOptions{Compression: compression})
+		assert.NoError(t, err)
+		defer os.Remove(filename)
+
+		content, _ := ioutil.ReadFile(filename)
+		junk := bytes.Repeat([]byte{0x7f, 'E', 'L', 'F'}, 300)
+		ioutil.WriteFile(bundle, append(junk, content...), 0644)
+		defer os.Remove(bundle)
+
+		reader, err := OpenAt(bundle, int64(len(junk)))
+		assert.NoError(t, err)
+
+		names := []string{}
+		for {
+			header, err := reader.Next()
+			if err != nil {
+				assert.Equal(t, io.EOF, err)
+				break
+			}
+			names = append(names, header.Name)
+			if header.Name == "c/c1.txt" {
+				content, err := ioutil.ReadAll(reader)
+				assert.NoError(t, err)
+				assert.Equal(t, "f1.txt\n", string(content))
+			}
+		}
+		assert.NoError(t, reader.Close())
+
+		assert.Equal(t, []string{"a.txt", "b.txt", "c", "c/c1.txt", "c/c2.txt", "symlink.txt"}, names)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	names, err := Split(filename, 4000)
+	assert.NoError(t, err)
+	for _, name := range names {
+		defer os.Remove(name)
+	}
+
+	assert.Equal(t, []string{filename + ".001", filename + ".002"}, names)
+
+	// The first volume ends right after c/c1.txt
+	info, _ := os.Stat(names[0])
+	assert.Equal(t, int64(3584), info.Size())
+
+	reader, err := OpenSplit(names)
+	assert.NoError(t, err)
+
+	headers := []string{}
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		headers = append(headers, header.Name)
+		if header.Name == "c/c2.txt" {
+			content, err := ioutil.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, "f2.txt\n", string(content))
+		}
+	}
+	assert.NoError(t, reader.Close())
+
+	assert.Equal(t, []string{"a.txt", "b.txt", "c", "c/c1.txt", "c/c2.txt", "symlink.txt"}, headers)
+}
+
+func TestExtractWithNegatedFilters(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{Filters: []string{"c", "!c/c1.txt"}})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/output/a.txt"))
+	assert.Equal(t, false, pathExists("tests/output/c/c1.txt"))
+	assert.Equal(t, "f2.txt\n", readContent("tests/output/c/c2.txt"))
+
+	os.RemoveAll("tests/output")
+
+	// The last filter matching wins
+	err = Extract(filename, "tests/output", &ExtractOptions{Filters: []string{"!c", "c/c2.txt"}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, false, pathExists("tests/output/c/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+
+	os.RemoveAll("tests/output")
+
+	// Negations alone only exclude
+	err = Extract(filename, "tests/output", &ExtractOptions{Filters: []string{"!c"}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, true, pathExists("tests/output/a.txt"))
+	assert.Equal(t, false, pathExists("tests/output/c"))
+}
+
+func TestExtractWithSymlinkMode(t *testing.T) {
+	filename := "tests/test.tar"
+
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "link.txt", Typeflag: tar.TypeSymlink, Linkname: "c/c1.txt"}},
+		{Header: &tar.Header{Name: "c/link.txt", Typeflag: tar.TypeSymlink, Linkname: "../link.txt"}},
+		{Header: &tar.Header{Name: "c/c1.txt", Typeflag: tar.TypeReg, Mode: 0640, Size: 6}, Body: strings.NewReader("c1.txt")},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{SymlinkMode: SymlinkCopy})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	for _, name := range []string{"tests/output/link.txt", "tests/output/c/link.txt"} {
+		info, err := os.Lstat(name)
+		assert.NoError(t, err)
+		assert.Equal(t, true, info.Mode().IsRegular())
+		assert.Equal(t, "c1.txt", readContent(name))
+	}
+
+	os.RemoveAll("tests/output")
+
+	err = Extract(filename, "tests/output", &ExtractOptions{SymlinkMode: SymlinkSkip})
+	assert.NoError(t, err)
+
+	assert.Equal(t, false, pathExists("tests/output/link.txt"))
+	assert.Equal(t, "c1.txt", readContent("tests/output/c/c1.txt"))
+
+	// Symlinks to directories cannot be copied
+	err = Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	entries = []EntrySpec{{Header: &tar.Header{Name: "dir", Typeflag: tar.TypeSymlink, Linkname: "c"}}}
+	err = WriteEntries(filename, entries, &CompressOptions{Append: true})
+	assert.NoError(t, err)
+
+	err = Extract(filename, "tests/output2", &ExtractOptions{SymlinkMode: SymlinkCopy})
+	assert.Error(t, err)
+	defer os.RemoveAll("tests/output2")
+}
+
+func TestReadAll(t *testing.T) {
+	filename := "tests/test.tar.gz"
+
+	err := Compress(filename, "tests/input", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	items, err := ReadAll(filename, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(items))
+
+	for _, item := range items {
+		info, err := os.Lstat(filepath.Join("tests/input", item.Header.Name))
+		assert.NoError(t, err)
+		assert.Equal(t, info.Mode(), item.Header.FileInfo().Mode())
+
+		if info.Mode().IsRegular() {
+			assert.Equal(t, readContent(filepath.Join("tests/input", item.Header.Name)), string(item.Data))
+		} else {
+			assert.Nil(t, item.Data)
+		}
+	}
+
+	assert.Equal(t, "c/c1.txt", items[3].Header.Name)
+	assert.Equal(t, "a.txt", items[5].Header.Linkname)
+
+	_, err = ReadAll(filename, 10)
+	assert.Equal(t, ErrSizeLimitExceeded, err)
+}
+
+func TestCompressWithEmitRootEntry(t *testing.T) {
+	filename := "tests/test.tar"
+
+	for _, emit := range []bool{true, false} {
+		err := Compress(filename, "tests/input", &CompressOptions{EmitRootEntry: emit})
+		assert.NoError(t, err)
+		defer os.Remove(filename)
+
+		headers, err := List(filename)
+		assert.NoError(t, err)
+
+		if emit {
+			assert.Equal(t, 7, len(headers))
+			assert.Equal(t, "./", headers[0].Name)
+			assert.Equal(t, byte(tar.TypeDir), headers[0].Typeflag)
+		} else {
+			assert.Equal(t, 6, len(headers))
+			assert.Equal(t, "a.txt", headers[0].Name)
+		}
+
+		err = Extract(filename, "tests/output", nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "a.txt\n", readContent("tests/output/a.txt"))
+		os.RemoveAll("tests/output")
+	}
+}
+
+func TestCompressFileList(t *testing.T) {
+	filename := "tests/test.tar"
+	list := "tests/list.txt"
+
+	writeContent(list, "tests/input/a.txt\ntests/input/c/c1.txt\r\n\ntests/input/missing.txt\n")
+	defer os.Remove(list)
+
+	err := CompressFileList(filename, list, nil)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, false, pathExists(filename))
+
+	err = CompressFileList(filename, list, &CompressOptions{SkipMissing: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(headers))
+	assert.Equal(t, "a.txt", headers[0].Name)
+	assert.Equal(t, "c/c1.txt", headers[1].Name)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "f1.txt\n", readContent("tests/output/c/c1.txt"))
+}
+
+func TestExtractSkipsFilteredDirs(t *testing.T) {
+	filename := "tests/test.tar"
+
+	// The entries of c are not next to each other
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "c/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{Header: &tar.Header{Name: "c/c1.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}, Body: strings.NewReader("c1")},
+		{Header: &tar.Header{Name: "cd.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}, Body: strings.NewReader("cd")},
+		{Header: &tar.Header{Name: "c/c2.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}, Body: strings.NewReader("c2")},
+		{Header: &tar.Header{Name: "d/c/c3.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}, Body: strings.NewReader("c3")},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{Filters: []string{"!c"}})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/output/c"))
+	assert.Equal(t, "cd", readContent("tests/output/cd.txt"))
+	assert.Equal(t, "c3", readContent("tests/output/d/c/c3.txt"))
+
+	os.RemoveAll("tests/output")
+
+	err = Extract(filename, "tests/output", &ExtractOptions{Filters: []string{"cd.txt", "d"}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, false, pathExists("tests/output/c"))
+	assert.Equal(t, "cd", readContent("tests/output/cd.txt"))
+	assert.Equal(t, "c3", readContent("tests/output/d/c/c3.txt"))
+}
+
+func TestReadFile(t *testing.T) {
+	defer os.Remove("tests/test.tar.gz")
+	defer os.Remove("tests/test.zip")
+
+	err := Compress("tests/test.tar.gz", "tests/input", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+
+	file, _ := os.Create("tests/test.zip")
+	writer := zip.NewWriter(file)
+	writer.Create("c/")
+	entry, _ := writer.Create("a.txt")
+	entry.Write([]byte("a.txt\n"))
+	writer.Close()
+	file.Close()
+
+	for _, fileName := range []string{"tests/test.tar.gz", "tests/test.zip"} {
+		content, err := ReadFile(fileName, "a.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, "a.txt\n", string(content))
+
+		_, err = ReadFile(fileName, "missing.txt")
+		assert.Equal(t, os.ErrNotExist, err)
+
+		_, err = ReadFile(fileName, "c")
+		assert.Error(t, err)
+	}
+}
+
+func TestConcat(t *testing.T) {
+	filename1 := "tests/test1.tar"
+	filename2 := "tests/test2.tar.gz"
+
+	err := Compress(filename1, "tests/input/c", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename1)
+
+	err = Compress(filename2, "tests/input/a.txt", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename2)
+
+	reader, err := Concat([]string{filename1, filename2})
+	assert.NoError(t, err)
+
+	names := []string{}
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		names = append(names, header.Name)
+		if header.Name == "a.txt" {
+			content, err := ioutil.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, "a.txt\n", string(content))
+		}
+	}
+	assert.NoError(t, reader.Close())
+
+	assert.Equal(t, []string{"c1.txt", "c2.txt", "a.txt"}, names)
+
+	_, err = Concat(nil)
+	assert.Error(t, err)
+}
+
+func TestReaderWithDedupAndPerEntry(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/dedup", os.ModePerm)
+	defer os.RemoveAll("tests/dedup")
+	writeContent("tests/dedup/a.txt", "same")
+	writeContent("tests/dedup/b.txt", "same")
+
+	err := Compress(filename, "tests/dedup", &CompressOptions{Dedup: true, PerEntryCompression: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	reader, err := Concat([]string{filename})
+	assert.NoError(t, err)
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		header, err := reader.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, name, header.Name)
+		content, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "same", string(content))
+	}
+	assert.NoError(t, reader.Close())
+
+	// The tar file of OpenAt cannot be read again
+	reader, err = OpenAt(filename, 0)
+	assert.NoError(t, err)
+
+	_, err = reader.Next()
+	assert.NoError(t, err)
+	content, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "same", string(content))
+
+	_, err = reader.Next()
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	assert.Error(t, err)
+
+	_, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, reader.Close())
+}
+
+func TestExtractWithSkeletonOnly(t *testing.T) {
+	filename := "tests/test.tar.gz"
+
+	err := Compress(filename, "tests/input", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{SkeletonOnly: true, PreserveTimes: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	err = Extract(filename, "tests/output2", &ExtractOptions{PreserveTimes: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output2")
+
+	for _, name := range []string{"a.txt", "b.txt", "c/c1.txt", "c/c2.txt"} {
+		expected, _ := os.Stat(filepath.Join("tests/output2", name))
+		info, err := os.Stat(filepath.Join("tests/output", name))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), info.Size())
+		assert.Equal(t, expected.Mode(), info.Mode())
+		assert.Equal(t, expected.ModTime(), info.ModTime())
+	}
+
+	info, err := os.Stat("tests/output/c")
+	assert.NoError(t, err)
+	assert.Equal(t, true, info.IsDir())
+
+	link, err := os.Readlink("tests/output/symlink.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", link)
+}
+
+func TestCountMatching(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	for _, test := range []struct {
+		filters  []string
+		expected int
+	}{
+		{nil, 6},
+		{[]string{"a.txt"}, 1},
+		{[]string{"c"}, 3},
+		{[]string{"c", "!c/c1.txt"}, 2},
+		{[]string{"!c"}, 3},
+		{[]string{"missing.txt"}, 0},
+	} {
+		count, err := CountMatching(filename, test.filters)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, count, test.filters)
+	}
+}
+
+func TestUnusedFilterFunc(t *testing.T) {
+	filename := "tests/test.tar"
+
+	filters := []string{"a.txt", "c/c3.txt", "c", "!c/c1.tx"}
+
+	unused := []string{}
+	err := Compress(filename, "tests/input", &CompressOptions{
+		Filters:          filters,
+		UnusedFilterFunc: func(filter string) { unused = append(unused, filter) },
+	})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	assert.Equal(t, []string{"c/c3.txt", "!c/c1.tx"}, unused)
+
+	unused = []string{}
+	err = Extract(filename, "tests/output", &ExtractOptions{
+		Filters:          append(filters, "b.txt"),
+		UnusedFilterFunc: func(filter string) { unused = append(unused, filter) },
+	})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, []string{"c/c3.txt", "!c/c1.tx", "b.txt"}, unused)
+}
+
+func TestCompressVolumes(t *testing.T) {
+	filename := "tests/test.tar"
+
+	names, err := CompressVolumes(filename, "tests/input", 2048, nil)
+	assert.NoError(t, err)
+	for _, name := range names {
+		defer os.Remove(name)
+	}
+
+	// The volumes end after b.txt, c/c1.txt and symlink.txt
+	assert.Equal(t, []string{filename + ".001", filename + ".002", filename + ".003", filename + ".004"}, names)
+	assert.Equal(t, false, pathExists(filename))
+
+	for _, name := range names {
+		info, err := os.Stat(name)
+		assert.NoError(t, err)
+		assert.True(t, info.Size() <= 2048)
+	}
+
+	reader, err := OpenSplit(names)
+	assert.NoError(t, err)
+
+	headers := []string{}
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		headers = append(headers, header.Name)
+	}
+	assert.NoError(t, reader.Close())
+
+	assert.Equal(t, []string{"a.txt", "b.txt", "c", "c/c1.txt", "c/c2.txt", "symlink.txt"}, headers)
+
+	// Compressed tar files are split anywhere
+	names, err = CompressVolumes(filename, "tests/input", 64, &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	for _, name := range names {
+		defer os.Remove(name)
+	}
+	assert.True(t, len(names) > 1)
+
+	reader, err = OpenSplit(names)
+	assert.NoError(t, err)
+	_, err = reader.Next()
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+}
+
+func TestCompressVolumesWithError(t *testing.T) {
+	filename := "tests/test.tar"
+
+	defer func(f func(string) (io.ReadCloser, error)) { openFile = f }(openFile)
+	openFile = func(fileName string) (io.ReadCloser, error) {
+		if filepath.Base(fileName) == "c2.txt" {
+			return nil, os.ErrPermission
+		}
+		return os.Open(fileName)
+	}
+
+	_, err := CompressVolumes(filename, "tests/input", 2048, nil)
+	assert.Equal(t, os.ErrPermission, err)
+
+	// The volumes written before the error are removed
+	assert.Equal(t, false, pathExists(filename+".001"))
+	assert.Equal(t, false, pathExists(filename+".002"))
+}
+
+func TestExtractWithConcurrency(t *testing.T) {
+	filename := "tests/test.tar.gz"
+
+	big := strings.Repeat("big\n", 400*1024)
+
+	entries := []EntrySpec{}
+	for i := 0; i < 200; i++ {
+		dir := fmt.Sprintf("d%d", i%7)
+		if i < 7 {
+			entries = append(entries, EntrySpec{Header: &tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755}})
+		}
+		content := strings.Repeat(fmt.Sprintf("file %d\n", i), i*10)
+		name := fmt.Sprintf("%s/f%d.txt", dir, i)
+		entries = append(entries, EntrySpec{
+			Header: &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))},
+			Body:   strings.NewReader(content),
+		})
+		if i%50 == 0 {
+			entries = append(entries, EntrySpec{Header: &tar.Header{Name: name + ".link", Typeflag: tar.TypeSymlink, Linkname: fmt.Sprintf("f%d.txt", i)}})
+		}
+		// Large files are written as they are read while the workers write the others
+		if i == 100 {
+			entries = append(entries, EntrySpec{
+				Header: &tar.Header{Name: "big.bin", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(big))},
+				Body:   strings.NewReader(big),
+			})
+		}
+	}
+	// The last occurrence of a file wins
+	entries = append(entries, EntrySpec{
+		Header: &tar.Header{Name: "d0/f0.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		Body:   strings.NewReader("last"),
+	})
+
+	err := WriteEntries(filename, entries, &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{Concurrency: 8, PreserveTimes: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	for i := 1; i < 200; i++ {
+		name := fmt.Sprintf("tests/output/d%d/f%d.txt", i%7, i)
+		assert.Equal(t, strings.Repeat(fmt.Sprintf("file %d\n", i), i*10), readContent(name))
+	}
+	assert.Equal(t, "last", readContent("tests/output/d0/f0.txt"))
+	assert.Equal(t, strings.Repeat("file 50\n", 500), readContent("tests/output/d1/f50.txt.link"))
+	assert.Equal(t, big, readContent("tests/output/big.bin"))
+
+	// Placeholders are created without reading the contents
+	os.RemoveAll("tests/output")
+
+	err = Extract(filename, "tests/output", &ExtractOptions{Concurrency: 8, SkeletonOnly: true})
+	assert.NoError(t, err)
+
+	info, err := os.Stat("tests/output/d3/f10.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	// Errors of the workers abort the extraction
+	os.RemoveAll("tests/output")
+	os.MkdirAll("tests/output/d3/f10.txt", os.ModePerm)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{Concurrency: 8})
+	assert.Error(t, err)
+}
+
+func TestCompressBlob(t *testing.T) {
+	filename := "tests/test.tar.gz"
+
+	err := CompressBlob(filename, "blob.txt", []byte("blob"), &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	header, reader, err := Find(filename, "blob.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), header.Size)
+	b, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "blob", string(b))
+	assert.NoError(t, reader.Close())
+}
+
+func TestValidateStructure(t *testing.T) {
+	filename := "tests/test.tar"
+
+	header := &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644}
+	writeTar(filename, header, strings.Repeat("a", 1000))
+	defer os.Remove(filename)
+
+	err := ValidateStructure(filename)
+	assert.NoError(t, err)
+
+	// Truncates the file in the middle of the body
+	err = os.Truncate(filename, 1012)
+	assert.NoError(t, err)
+
+	err = ValidateStructure(filename)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+}
+
+func TestVerify(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{AppendChecksum: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, len(headers))
+	assert.Equal(t, ChecksumEntryName, headers[6].Name)
+
+	assert.NoError(t, Verify(filename))
+
+	// Changes the content of b.txt inside the tar file
+	entries, _ := Index(filename)
+	file, _ := os.OpenFile(filename, os.O_RDWR, os.ModePerm)
+	file.WriteAt([]byte("x"), entries[1].Offset)
+	file.Close()
+
+	assert.Equal(t, ErrChecksumMismatch, Verify(filename))
+}
+
+func TestVerifyAppended(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input/a.txt", &CompressOptions{AppendChecksum: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Compress(filename, "tests/input/c", &CompressOptions{Append: true, AppendChecksum: true})
+	assert.NoError(t, err)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(headers))
+	assert.Equal(t, ChecksumEntryName, headers[3].Name)
+
+	assert.NoError(t, Verify(filename))
+}
+
+func TestVerifyWithCheckpoint(t *testing.T) {
+	filename := "tests/test.tar"
+	checkpoint := "tests/checkpoint"
+
+	defer os.Remove(filename)
+	defer os.Remove(checkpoint)
+
+	interrupt := true
+	defer func(f func(string) (io.ReadCloser, error)) { openFile = f }(openFile)
+	openFile = func(fileName string) (io.ReadCloser, error) {
+		if interrupt && filepath.Base(fileName) == "c1.txt" {
+			return nil, os.ErrPermission
+		}
+		return os.Open(fileName)
+	}
+
+	options := &CompressOptions{Checkpoint: checkpoint, AppendChecksum: true}
+	err := Compress(filename, "tests/input", options)
+	assert.Equal(t, os.ErrPermission, err)
+	assert.Equal(t, ErrChecksumNotFound, Verify(filename))
+
+	interrupt = false
+	options.Append = true
+	err = Compress(filename, "tests/input", options)
+	assert.NoError(t, err)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, len(headers))
+	assert.Equal(t, ChecksumEntryName, headers[6].Name)
+
+	assert.NoError(t, Verify(filename))
+}
+
+func TestVerifyWithoutChecksum(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	assert.Equal(t, ErrChecksumNotFound, Verify(filename))
+}
+
+func TestVerifyTruncated(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{AppendChecksum: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	// Truncates the file in the middle of the header of c, the third entry
+	err = os.Truncate(filename, 2300)
+	assert.NoError(t, err)
+
+	err = Verify(filename)
+	corruptErr, ok := err.(*CorruptError)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2300), corruptErr.Offset)
+	assert.Equal(t, "b.txt", corruptErr.LastEntry)
+	assert.Equal(t, io.ErrUnexpectedEOF, corruptErr.Err)
+}
+
+func TestCompressSymlinkedDir(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeSymlinkTree("tests/follow")
+	defer os.RemoveAll("tests/follow")
+
+	err := Compress(filename, "tests/follow", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, header := range headers {
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{"d", "d/loop", "d/x.txt", "file.lnk", "link"}, names)
+	assert.Equal(t, byte(tar.TypeSymlink), headers[4].Typeflag)
+}
+
+func TestCompressWithFollowSymlinks(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeSymlinkTree("tests/follow")
+	defer os.RemoveAll("tests/follow")
+
+	err := Compress(filename, "tests/follow", &CompressOptions{FollowSymlinks: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, header := range headers {
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{"d", "d/loop", "d/x.txt", "file.lnk", "link", "link/loop", "link/x.txt"}, names)
+	assert.Equal(t, byte(tar.TypeDir), headers[1].Typeflag)
+	assert.Equal(t, byte(tar.TypeReg), headers[3].Typeflag)
+	assert.Equal(t, byte(tar.TypeDir), headers[4].Typeflag)
+}
+
+func TestCompressWithDedup(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/dedup", os.ModePerm)
+	defer os.RemoveAll("tests/dedup")
+	writeContent("tests/dedup/a.txt", "same")
+	writeContent("tests/dedup/b.txt", "same")
+	writeContent("tests/dedup/c.txt", "other")
+
+	err := Compress(filename, "tests/dedup", &CompressOptions{Dedup: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), headers[0].Size)
+	assert.Equal(t, int64(0), headers[1].Size)
+	assert.Equal(t, "a.txt", headers[1].PAXRecords["TARX.dedup"])
+	assert.Equal(t, int64(5), headers[2].Size)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "same", readContent("tests/output/a.txt"))
+	assert.Equal(t, "same", readContent("tests/output/b.txt"))
+	assert.Equal(t, "other", readContent("tests/output/c.txt"))
+}
+
+func TestReadDedupEntries(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/dedup", os.ModePerm)
+	defer os.RemoveAll("tests/dedup")
+	writeContent("tests/dedup/a.txt", "same")
+	writeContent("tests/dedup/b.txt", "same")
+
+	err := Compress(filename, "tests/dedup", &CompressOptions{Dedup: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	content, err := ReadFile(filename, "b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "same", string(content))
+
+	header, reader, err := Find(filename, "b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", header.PAXRecords["TARX.dedup"])
+	content, err = ioutil.ReadAll(reader)
+	reader.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "same", string(content))
+
+	files, err := ExtractToMap(filename, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("same"), files["b.txt"])
+
+	items, err := ReadAll(filename, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "b.txt", items[1].Header.Name)
+	assert.Equal(t, []byte("same"), items[1].Data)
+
+	// The original entry is read again when it is not extracted
+	err = Extract(filename, "tests/output", &ExtractOptions{Filters: []string{"b.txt"}})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/output/a.txt"))
+	assert.Equal(t, "same", readContent("tests/output/b.txt"))
+
+	os.RemoveAll("tests/output")
+
+	count, err := ExtractGlob(filename, "tests/output", "b.*")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, "same", readContent("tests/output/b.txt"))
+
+	// Tar streams cannot be read again
+	file, _ := os.Open(filename)
+	defer file.Close()
+	err = ExtractStream(file, "tests/stream", &ExtractOptions{Filters: []string{"b.txt"}})
+	assert.Error(t, err)
+	defer os.RemoveAll("tests/stream")
+}
+
+func TestCompressFolderWithIncludeSourceDirMetadata(t *testing.T) {
+	filename := "tests/test.tar"
+
+	mtime := time.Date(2015, 12, 5, 10, 0, 0, 0, time.UTC)
+	os.MkdirAll("tests/root/d", 0700)
+	defer os.RemoveAll("tests/root")
+	os.Chmod("tests/root", 0750)
+	os.Chtimes("tests/root", mtime, mtime)
+
+	err := Compress(filename, "tests/root", &CompressOptions{IncludeSourceDir: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(headers))
+	assert.Equal(t, "root", headers[0].Name)
+	assert.Equal(t, byte(tar.TypeDir), headers[0].Typeflag)
+	assert.Equal(t, os.ModeDir|0750, headers[0].FileInfo().Mode())
+	assert.Equal(t, mtime.Unix(), headers[0].ModTime.Unix())
+	assert.Equal(t, "root/d", headers[1].Name)
+	assert.Equal(t, os.ModeDir|0700, headers[1].FileInfo().Mode())
+}
+
+func TestWriteEntries(t *testing.T) {
+	filename := "tests/test.tar"
+
+	mtime := time.Date(2015, 12, 5, 10, 0, 0, 0, time.UTC)
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}},
+		{Header: &tar.Header{Name: "dir/a.txt", Typeflag: tar.TypeReg, Mode: 0600, Size: 5, ModTime: mtime, Uname: "custom"}, Body: strings.NewReader("a.txt")},
+		{Header: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir/a.txt", ModTime: mtime}},
+	}
+
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	header, reader, err := Find(filename, "dir/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "custom", header.Uname)
+	assert.Equal(t, int64(0600), header.Mode)
+	assert.Equal(t, mtime, header.ModTime.UTC())
+	b, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "a.txt", string(b))
+	reader.Close()
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(headers))
+	assert.Equal(t, "dir/a.txt", headers[2].Linkname)
+}
+
+func TestWriteEntriesWithWrongSize(t *testing.T) {
+	filename := "tests/test.tar"
+
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 10}, Body: strings.NewReader("a.txt")},
+	}
+
+	err := WriteEntries(filename, entries, nil)
+	assert.EqualError(t, err, "Entry a.txt has 5 bytes but its size is 10")
+	assert.Equal(t, false, pathExists(filename))
+}
+
 func TestAppendFile(t *testing.T) {
 	filename := "tests/test.tar"
 
-	err := Compress(filename, "tests/input/c", nil)
-	assert.NoError(t, err)
+	err := Compress(filename, "tests/input/c", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Compress(filename, "tests/input/a.txt", &CompressOptions{Append: true})
+	assert.NoError(t, err)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, len(headers))
+	assert.Equal(t, "c1.txt", headers[0].Name)
+	assert.Equal(t, "c2.txt", headers[1].Name)
+	assert.Equal(t, "a.txt", headers[2].Name)
+}
+
+func TestAppendFolder(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input/a.txt", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Compress(filename, "tests/input/c", &CompressOptions{Append: true, IncludeSourceDir: true})
+	assert.NoError(t, err)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, len(headers))
+	assert.Equal(t, "a.txt", headers[0].Name)
+	assert.Equal(t, "c", headers[1].Name)
+	assert.Equal(t, "c/c1.txt", headers[2].Name)
+	assert.Equal(t, "c/c2.txt", headers[3].Name)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "a.txt\n", readContent("tests/output/a.txt"))
+	assert.Equal(t, readContent("tests/input/c/c2.txt"), readContent("tests/output/c/c2.txt"))
+}
+
+func TestAppendFileToPaddedTar(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input/a.txt", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	// GNU tar pads tar files to records of 10240 bytes
+	os.Truncate(filename, 10240)
+
+	err = Compress(filename, "tests/input/b.txt", &CompressOptions{Append: true})
+	assert.NoError(t, err)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(headers))
+	assert.Equal(t, "a.txt", headers[0].Name)
+	assert.Equal(t, "b.txt", headers[1].Name)
+}
+
+func TestAppendFileWithGzip(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input/c", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Compress(filename, "tests/input/a.txt", &CompressOptions{Append: true})
+	assert.EqualError(t, ErrAppendNotSupported, err.Error())
+}
+
+func TestCompressIncremental(t *testing.T) {
+	filename := "tests/test.tar"
+
+	options := &CompressOptions{Incremental: true, SnapshotTime: time.Now().Add(time.Hour)}
+	err := Compress(filename, "tests/input", options)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, len(headers))
+	assert.Equal(t, "c", headers[0].Name)
+	assert.Equal(t, typeGNUDumpDir, headers[0].Typeflag)
+}
+
+func TestExtractIncremental(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{Incremental: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, true, pathExists("tests/output/a.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c"))
+	assert.Equal(t, true, pathExists("tests/output/c/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+}
+
+func TestNormalizeTimestamps(t *testing.T) {
+	filename := "tests/test.tar.gz"
+	normalized := "tests/normalized.tar.gz"
+
+	err := Compress(filename, "tests/input", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	epoch := time.Unix(315532800, 0)
+
+	err = NormalizeTimestamps(filename, normalized, epoch)
+	assert.NoError(t, err)
+	defer os.Remove(normalized)
+
+	headers, err := List(normalized)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(headers))
+	for _, header := range headers {
+		assert.True(t, epoch.Equal(header.ModTime))
+		if !header.AccessTime.IsZero() {
+			assert.True(t, epoch.Equal(header.AccessTime))
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress("tests/a.tar.gz", "tests/input/a.txt", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove("tests/a.tar.gz")
+
+	err = Compress("tests/c.tar", "tests/input/c", nil)
+	assert.NoError(t, err)
+	defer os.Remove("tests/c.tar")
+
+	err = Merge(filename, []string{"tests/a.tar.gz", "tests/c.tar", "tests/a.tar.gz"}, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, len(headers))
+	assert.Equal(t, "a.txt", headers[0].Name)
+	assert.Equal(t, "c1.txt", headers[1].Name)
+	assert.Equal(t, "c2.txt", headers[2].Name)
+
+	header, reader, err := Find(filename, "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", header.Name)
+	b, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "a.txt\n", string(b))
+	reader.Close()
+}
+
+func TestMergeWithCollisionError(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress("tests/a.tar", "tests/input/a.txt", nil)
+	assert.NoError(t, err)
+	defer os.Remove("tests/a.tar")
+
+	err = Merge(filename, []string{"tests/a.tar", "tests/a.tar"}, &CompressOptions{Collision: CollisionError})
+	assert.Equal(t, ErrDuplicateEntry, err)
+	assert.Equal(t, false, pathExists(filename))
+}
+
+func TestMergeWithDedup(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/dedup", os.ModePerm)
+	defer os.RemoveAll("tests/dedup")
+	writeContent("tests/dedup/a.txt", "same")
+	writeContent("tests/dedup/b.txt", "same")
+
+	err := Compress("tests/a.tar", "tests/input/a.txt", nil)
+	assert.NoError(t, err)
+	defer os.Remove("tests/a.tar")
+
+	err = Compress("tests/dedup.tar", "tests/dedup", &CompressOptions{Dedup: true, PerEntryCompression: true})
+	assert.NoError(t, err)
+	defer os.Remove("tests/dedup.tar")
+
+	// The a.txt kept is not the one b.txt references
+	err = Merge(filename, []string{"tests/a.tar", "tests/dedup.tar"}, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(headers))
+	assert.Equal(t, "b.txt", headers[1].Name)
+	assert.Equal(t, "", headers[1].PAXRecords["TARX.dedup"])
+
+	content, err := ReadFile(filename, "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt\n", string(content))
+
+	content, err = ReadFile(filename, "b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "same", string(content))
+}
+
+func TestMergeWithAppendChecksum(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress("tests/a.tar", "tests/input/a.txt", &CompressOptions{AppendChecksum: true})
+	assert.NoError(t, err)
+	defer os.Remove("tests/a.tar")
+
+	err = Compress("tests/c.tar", "tests/input/c", &CompressOptions{AppendChecksum: true})
+	assert.NoError(t, err)
+	defer os.Remove("tests/c.tar")
+
+	err = Merge(filename, []string{"tests/a.tar", "tests/c.tar"}, &CompressOptions{Collision: CollisionError, AppendChecksum: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(headers))
+	assert.Equal(t, ChecksumEntryName, headers[3].Name)
+
+	assert.NoError(t, Verify(filename))
+
+	// The checksum of the source no longer matches the entries kept
+	err = Filter("tests/c.tar", filename, func(header *tar.Header) bool {
+		return header.Name != "c1.txt"
+	}, nil)
+	assert.NoError(t, err)
+
+	headers, err = List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(headers))
+	assert.Equal(t, ErrChecksumNotFound, Verify(filename))
+}
+
+func TestFilter(t *testing.T) {
+	filename := "tests/test.tar.gz"
+
+	os.MkdirAll("tests/logs/c", os.ModePerm)
+	defer os.RemoveAll("tests/logs")
+	writeContent("tests/logs/a.txt", "a.txt")
+	writeContent("tests/logs/b.log", "b.log")
+	writeContent("tests/logs/c/c1.log", "c1.log")
+	writeContent("tests/logs/c/c2.txt", "c2.txt")
+
+	err := Compress("tests/logs.tar", "tests/logs", nil)
+	assert.NoError(t, err)
+	defer os.Remove("tests/logs.tar")
+
+	keep := func(header *tar.Header) bool {
+		return !strings.HasSuffix(header.Name, ".log")
+	}
+
+	err = Filter("tests/logs.tar", filename, keep, &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, len(headers))
+	assert.Equal(t, "a.txt", headers[0].Name)
+	assert.Equal(t, "c", headers[1].Name)
+	assert.Equal(t, "c/c2.txt", headers[2].Name)
+}
+
+func TestFilterWithDedup(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/dedup", os.ModePerm)
+	defer os.RemoveAll("tests/dedup")
+	writeContent("tests/dedup/a.txt", "same")
+	writeContent("tests/dedup/b.txt", "same")
+
+	err := Compress("tests/dedup.tar", "tests/dedup", &CompressOptions{Dedup: true})
+	assert.NoError(t, err)
+	defer os.Remove("tests/dedup.tar")
+
+	err = Filter("tests/dedup.tar", filename, func(header *tar.Header) bool {
+		return header.Name != "a.txt"
+	}, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(headers))
+	assert.Equal(t, int64(4), headers[0].Size)
+
+	content, err := ReadFile(filename, "b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "same", string(content))
+}
+
+func TestFindFile(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input/a.txt", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	header, reader, err := Find(filename, "a.txt")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a.txt", header.Name)
+	b, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "a.txt\n", string(b))
+	assert.Equal(t, nil, reader.Close())
+}
+
+func TestFindFileAfterClose(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input/a.txt", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	_, reader, err := Find(filename, "a.txt")
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+
+	_, err = reader.Read(make([]byte, 1))
+	assert.Equal(t, ErrReaderClosed, err)
+	assert.Equal(t, ErrReaderClosed, reader.Close())
+	assert.Equal(t, ErrReaderClosed, reader.(*tarReader).Next())
+}
+
+func TestFindDir(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	_, reader, err := Find(filename, "c")
+	assert.Equal(t, nil, reader)
+	assert.Equal(t, nil, err)
+}
+
+func TestReadNotExists(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input/a.txt", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	_, _, err = Find(filename, "notExists.txt")
+	assert.Equal(t, os.ErrNotExist, err)
+}
+
+func TestListContextCancel(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	count := 0
+	_, err = ListContext(ctx, filename, func(header *tar.Header) {
+		count++
+		if count == 2 {
+			cancel()
+		}
+	})
+	assert.Equal(t, ctx.Err(), err)
+	assert.Equal(t, 2, count)
+}
+
+func TestListBzip2MultiStream(t *testing.T) {
+	filename := "tests/test.tar.bz2"
+
+	// a.tar.bz2 has no end-of-archive marker, so both streams
+	// together make a single tar file
+	a, _ := ioutil.ReadFile("tests/multistream/a.tar.bz2")
+	c, _ := ioutil.ReadFile("tests/multistream/c.tar.bz2")
+	ioutil.WriteFile(filename, append(a, c...), os.ModePerm)
+	defer os.Remove(filename)
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, len(headers))
+	assert.Equal(t, "a.txt", headers[0].Name)
+	assert.Equal(t, "c/", headers[1].Name)
+	assert.Equal(t, "c/c1.txt", headers[2].Name)
+	assert.Equal(t, "c/c2.txt", headers[3].Name)
+}
+
+func TestListTruncatedGzip(t *testing.T) {
+	filename := "tests/test.tar.gz"
+
+	err := Compress(filename, "tests/input", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	// Drops the gzip trailer, the tar content is still complete
+	info, _ := os.Stat(filename)
+	os.Truncate(filename, info.Size()-4)
+
+	_, err = List(filename)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	defer os.RemoveAll("tests/output")
+}
+
+func TestStat(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	info, _ := os.Stat("tests/input/a.txt")
+
+	header, err := Stat(filename, "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), header.Size)
+
+	_, err = Stat(filename, "d.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStatDedupWithoutOriginal(t *testing.T) {
+	filename := "tests/test.tar"
+
+	header := &tar.Header{
+		Name:       "b.txt",
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		PAXRecords: map[string]string{"TARX.dedup": "a.txt"},
+		Format:     tar.FormatPAX,
+	}
+	writeTar(filename, header, "")
+	defer os.Remove(filename)
+
+	// The content is not read, so the missing original does not matter
+	header, err := Stat(filename, "b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", header.PAXRecords["TARX.dedup"])
+
+	_, _, err = Find(filename, "b.txt")
+	assert.Error(t, err)
+}
+
+func TestPAXRecords(t *testing.T) {
+	filename := "tests/test.tar"
+
+	header := &tar.Header{
+		Name:       "a.txt",
+		Typeflag:   tar.TypeReg,
+		Mode:       0644,
+		PAXRecords: map[string]string{"LIBARCHIVE.creationtime": "1449309600"},
+		Format:     tar.FormatPAX,
+	}
+	writeTar(filename, header, "a.txt")
+	defer os.Remove(filename)
+
+	records, err := PAXRecords(filename, "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "1449309600", records["LIBARCHIVE.creationtime"])
+
+	headers, err := List(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "1449309600", headers[0].PAXRecords["LIBARCHIVE.creationtime"])
+
+	_, err = PAXRecords(filename, "b.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTopLevelEntries(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	names, err := TopLevelEntries(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt", "c", "symlink.txt"}, names)
+
+	err = Compress(filename, "tests/input", &CompressOptions{IncludeSourceDir: true})
+	assert.NoError(t, err)
+
+	names, err = TopLevelEntries(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"input"}, names)
+}
+
+func TestDetectFormat(t *testing.T) {
+	defer os.Remove("tests/test.tar")
+	defer os.Remove("tests/test.tar.gz")
+	defer os.Remove("tests/test.zip")
+
+	err := Compress("tests/test.tar", "tests/input", nil)
+	assert.NoError(t, err)
+
+	err = Compress("tests/test.tar.gz", "tests/input", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+
+	file, _ := os.Create("tests/test.zip")
+	writer := zip.NewWriter(file)
+	entry, _ := writer.Create("a.txt")
+	entry.Write([]byte("a.txt"))
+	writer.Close()
+	file.Close()
+
+	for fileName, expected := range map[string]Format{
+		"tests/test.tar":              FormatTar,
+		"tests/test.tar.gz":           FormatTarGzip,
+		"tests/multistream/c.tar.bz2": FormatTarBzip2,
+		"tests/test.zip":              FormatZip,
+		"tests/input/a.txt":           FormatUnknown,
+	} {
+		format, err := DetectFormat(fileName)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, format, fileName)
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	entries, err := ListEntries(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(entries))
+
+	info, _ := os.Stat("tests/input/a.txt")
+	assert.Equal(t, "a.txt", entries[0].Name)
+	assert.Equal(t, info.Size(), entries[0].Size)
+	assert.Equal(t, info.Mode(), entries[0].Mode)
+	assert.WithinDuration(t, info.ModTime(), entries[0].ModTime, time.Second)
+	assert.Equal(t, false, entries[0].IsDir)
+
+	assert.Equal(t, "c", entries[2].Name)
+	assert.Equal(t, true, entries[2].IsDir)
+	assert.Equal(t, true, entries[2].Mode.IsDir())
+
+	assert.Equal(t, "symlink.txt", entries[5].Name)
+	assert.Equal(t, os.ModeSymlink, entries[5].Mode&os.ModeSymlink)
+}
+
+func TestIndex(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	entries, err := Index(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, len(entries))
+	assert.Equal(t, "c/c2.txt", entries[4].Name)
+
+	file, _ := os.Open(filename)
+	defer file.Close()
+
+	b := make([]byte, entries[4].Size)
+	_, err = file.ReadAt(b, entries[4].Offset)
+	assert.NoError(t, err)
+	assert.Equal(t, "f2.txt\n", string(b))
+}
+
+func TestOpenWithIndex(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{WriteIndex: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+	defer os.Remove(filename + ".idx")
+
+	entries, err := Index(filename)
+	assert.NoError(t, err)
+
+	// The index written matches the one read from the tar file
+	content, err := ioutil.ReadFile(filename + ".idx")
+	assert.NoError(t, err)
+	index := []IndexEntry{}
+	json.Unmarshal(content, &index)
+	assert.Equal(t, entries, index)
+
+	reader, err := OpenWithIndex(filename, "c/c2.txt")
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	b, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "f2.txt\n", string(b))
+
+	_, err = OpenWithIndex(filename, "d.txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOpenWithIndexDedup(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/dedup", os.ModePerm)
+	defer os.RemoveAll("tests/dedup")
+	writeContent("tests/dedup/a.txt", "same")
+	writeContent("tests/dedup/b.txt", "same")
+
+	err := Compress(filename, "tests/dedup", &CompressOptions{Dedup: true, WriteIndex: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+	defer os.Remove(filename + ".idx")
+
+	entries, err := Index(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt", entries[1].Dedup)
+
+	reader, err := OpenWithIndex(filename, "b.txt")
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	b, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "same", string(b))
+}
+
+func TestWriteIndexWithEveryWriter(t *testing.T) {
+	filename := "tests/test.tar"
+	options := &CompressOptions{WriteIndex: true}
+
+	err := Compress("tests/c.tar", "tests/input/c", nil)
+	assert.NoError(t, err)
+	defer os.Remove("tests/c.tar")
+
+	ioutil.WriteFile("tests/list.txt", []byte("tests/input/c/c1.txt\ntests/input/c/c2.txt\n"), 0644)
+	defer os.Remove("tests/list.txt")
+
+	writers := map[string]func() error{
+		"CompressFileList": func() error {
+			return CompressFileList(filename, "tests/list.txt", options)
+		},
+		"CompressBlob": func() error {
+			return CompressBlob(filename, "c1.txt", []byte("f1.txt\n"), options)
+		},
+		"WriteEntries": func() error {
+			header := &tar.Header{Name: "c1.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 7}
+			return WriteEntries(filename, []EntrySpec{{Header: header, Body: strings.NewReader("f1.txt\n")}}, options)
+		},
+		"Merge": func() error {
+			return Merge(filename, []string{"tests/c.tar"}, options)
+		},
+		"Filter": func() error {
+			return Filter("tests/c.tar", filename, func(*tar.Header) bool { return true }, options)
+		},
+	}
+
+	for name, write := range writers {
+		os.Remove(filename + ".idx")
+
+		assert.NoError(t, write(), name)
+
+		reader, err := OpenWithIndex(filename, "c1.txt")
+		assert.NoError(t, err, name)
+		if err != nil {
+			continue
+		}
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		assert.Equal(t, "f1.txt\n", string(content), name)
+	}
+
+	os.Remove(filename)
+	os.Remove(filename + ".idx")
+
+	_, err = CompressVolumes(filename, "tests/input", 2048, options)
+	assert.Error(t, err)
+	assert.Equal(t, false, pathExists(filename+".001"))
+}
+
+func TestWriteEntriesWithFormat(t *testing.T) {
+	filename := "tests/test.tar"
+
+	mtime := time.Date(2015, 12, 5, 10, 0, 0, 500, time.UTC)
+	header := &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, AccessTime: mtime}
+	err := WriteEntries(filename, []EntrySpec{{Header: header}}, &CompressOptions{Format: tar.FormatUSTAR})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	header, err = Stat(filename, "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, tar.FormatUSTAR, header.Format)
+	assert.Equal(t, mtime.Truncate(time.Second), header.ModTime.UTC())
+}
+
+func TestIndexWithGzip(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	_, err = Index(filename)
+	assert.Equal(t, ErrIndexNotSupported, err)
+}
+
+func TestDiff(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/diff/c", os.ModePerm)
+	defer os.RemoveAll("tests/diff")
+	writeContent("tests/diff/a.txt", "a.txt")
+	writeContent("tests/diff/b.txt", "b.txt")
+	writeContent("tests/diff/c/c1.txt", "c1.txt")
+
+	err := Compress(filename, "tests/diff", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	result, err := Diff(filename, "tests/diff")
+	assert.NoError(t, err)
+	assert.Equal(t, &DiffResult{Missing: []string{}, Extra: []string{}, Changed: []string{}}, result)
+
+	writeContent("tests/diff/a.txt", "new a.txt")
+	os.Remove("tests/diff/b.txt")
+	writeContent("tests/diff/c/c2.txt", "c2.txt")
+
+	result, err = Diff(filename, "tests/diff")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.txt"}, result.Missing)
+	assert.Equal(t, []string{"c/c2.txt"}, result.Extra)
+	assert.Equal(t, []string{"a.txt"}, result.Changed)
+}
+
+func TestExtract(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, true, pathExists("tests/output/a.txt"))
+	assert.Equal(t, true, pathExists("tests/output/b.txt"))
+	assert.Equal(t, true, pathExists("tests/output/symlink.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c"))
+	assert.Equal(t, true, pathExists("tests/output/c/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+}
+
+func TestExtractStream(t *testing.T) {
+	filename := "tests/test.tar.gz"
+
+	err := Compress(filename, "tests/input", &CompressOptions{Compression: Gzip})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	content, _ := ioutil.ReadFile(filename)
+
+	err = ExtractStream(bytes.NewBuffer(content), "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "a.txt\n", readContent("tests/output/a.txt"))
+	assert.Equal(t, true, pathExists("tests/output/symlink.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+}
+
+func TestExtractStreamUncompressed(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	file, _ := os.Open(filename)
+	defer file.Close()
+
+	err = ExtractStream(ioutil.NopCloser(file), "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "a.txt\n", readContent("tests/output/a.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+}
+
+func TestExtractWithFlatDir(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{FlatDir: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, true, pathExists("tests/output/a.txt"))
+	assert.Equal(t, true, pathExists("tests/output/b.txt"))
+	assert.Equal(t, true, pathExists("tests/output/symlink.txt"))
+	assert.Equal(t, false, pathExists("tests/output/c"))
+	assert.Equal(t, true, pathExists("tests/output/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c2.txt"))
+}
+
+func TestExtractWithFilters(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	filters := []string{"a.txt", "c/c2.txt"}
+	err = Extract(filename, "tests/output", &ExtractOptions{Filters: filters})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, true, pathExists("tests/output/a.txt"))
+	assert.Equal(t, false, pathExists("tests/output/b.txt"))
+	assert.Equal(t, false, pathExists("tests/output/symlink.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c"))
+	assert.Equal(t, false, pathExists("tests/output/c/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+}
+
+func TestExtractWithFilterCreatesParentDir(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{Filters: []string{"c/c2.txt"}})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	srcInfo, _ := os.Stat("tests/input/c")
+	dirInfo, err := os.Stat("tests/output/c")
+	assert.NoError(t, err)
+	assert.Equal(t, true, dirInfo.IsDir())
+	assert.Equal(t, srcInfo.Mode(), dirInfo.Mode())
+	assert.Equal(t, false, pathExists("tests/output/c/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+}
+
+func TestExtractWithSubtreePrefix(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{SubtreePrefix: "c/"})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/output/a.txt"))
+	assert.Equal(t, false, pathExists("tests/output/c"))
+	assert.Equal(t, true, pathExists("tests/output/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c2.txt"))
+}
+
+func TestExtractGlob(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	count, err := ExtractGlob(filename, "tests/output", "*.txt")
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, 3, count)
+	assert.Equal(t, true, pathExists("tests/output/a.txt"))
+	assert.Equal(t, true, pathExists("tests/output/b.txt"))
+	assert.Equal(t, true, pathExists("tests/output/symlink.txt"))
+	assert.Equal(t, false, pathExists("tests/output/c"))
+
+	count, err = ExtractGlob(filename, "tests/output", "**/c*.txt")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, count)
+	assert.Equal(t, true, pathExists("tests/output/c/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+}
+
+func TestExtractWithVerifyManifest(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input/c", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	writeManifest("tests/manifest.json", "tests/input/c", "c1.txt", "c2.txt")
+	defer os.Remove("tests/manifest.json")
+
+	err = Extract(filename, "tests/output", &ExtractOptions{VerifyManifest: "tests/manifest.json"})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, true, pathExists("tests/output/c1.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c2.txt"))
+}
+
+func TestExtractWithVerifyManifestCorrupted(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input/c", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	writeManifest("tests/manifest.json", "tests/input/c", "c1.txt", "c2.txt")
+	defer os.Remove("tests/manifest.json")
+
+	// Changes the content of c2.txt inside the tar file
+	entries, _ := Index(filename)
+	file, _ := os.OpenFile(filename, os.O_RDWR, os.ModePerm)
+	file.WriteAt([]byte("x"), entries[1].Offset)
+	file.Close()
+
+	err = Extract(filename, "tests/output", &ExtractOptions{VerifyManifest: "tests/manifest.json"})
+	assert.EqualError(t, err, "Checksum mismatch for c2.txt")
+	defer os.RemoveAll("tests/output")
+}
+
+func TestExtractWithRenameFunc(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/rename/Docs", os.ModePerm)
+	defer os.RemoveAll("tests/rename")
+	writeContent("tests/rename/Docs/README.TXT", "readme")
+	writeContent("tests/rename/Skip.txt", "skip")
+
+	err := Compress(filename, "tests/rename", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	renameFunc := func(name string) (string, bool) {
+		if name == "Skip.txt" {
+			return "", false
+		}
+		return strings.ToLower(name), true
+	}
+
+	err = Extract(filename, "tests/output", &ExtractOptions{RenameFunc: renameFunc})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "readme", readContent("tests/output/docs/readme.txt"))
+	assert.Equal(t, false, pathExists("tests/output/skip.txt"))
+	assert.Equal(t, false, pathExists("tests/output/Skip.txt"))
+}
+
+func TestExtractWithControlCharacters(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeTar(filename, &tar.Header{Name: "bad\x1bname.txt", Typeflag: tar.TypeReg, Mode: 0644}, "")
 	defer os.Remove(filename)
 
-	err = Compress(filename, "tests/input/a.txt", &CompressOptions{Append: true})
+	err := Extract(filename, "tests/output", nil)
+	assert.EqualError(t, err, `Invalid entry name "bad\x1bname.txt"`)
+	defer os.RemoveAll("tests/output")
+
+	err = Extract(filename, "tests/output", &ExtractOptions{SanitizeNames: true})
 	assert.NoError(t, err)
+	assert.Equal(t, true, pathExists("tests/output/bad_name.txt"))
+}
 
-	headers, err := List(filename)
+func TestExtractToMap(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
 	assert.NoError(t, err)
+	defer os.Remove(filename)
 
-	assert.Equal(t, 3, len(headers))
-	assert.Equal(t, "c1.txt", headers[0].Name)
-	assert.Equal(t, "c2.txt", headers[1].Name)
-	assert.Equal(t, "a.txt", headers[2].Name)
+	files, err := ExtractToMap(filename, 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string][]byte{
+		"a.txt":    []byte("a.txt\n"),
+		"b.txt":    []byte("b.txt\n"),
+		"c/c1.txt": []byte(readContent("tests/input/c/c1.txt")),
+		"c/c2.txt": []byte(readContent("tests/input/c/c2.txt")),
+	}, files)
+
+	_, err = ExtractToMap(filename, 10)
+	assert.Equal(t, ErrSizeLimitExceeded, err)
 }
 
-func TestAppendFileWithGzip(t *testing.T) {
+func TestExtractToMapWithPerEntryCompression(t *testing.T) {
 	filename := "tests/test.tar"
 
-	err := Compress(filename, "tests/input/c", &CompressOptions{Compression: Gzip})
+	err := Compress(filename, "tests/input", &CompressOptions{PerEntryCompression: true})
 	assert.NoError(t, err)
 	defer os.Remove(filename)
 
-	err = Compress(filename, "tests/input/a.txt", &CompressOptions{Append: true})
-	assert.EqualError(t, ErrAppendNotSupported, err.Error())
+	files, err := ExtractToMap(filename, 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []byte("a.txt\n"), files["a.txt"])
+	assert.Equal(t, []byte("f1.txt\n"), files["c/c1.txt"])
+
+	_, err = ExtractToMap(filename, 10)
+	assert.Equal(t, ErrSizeLimitExceeded, err)
 }
 
-func TestFindFile(t *testing.T) {
+func TestExtractWithPreserveTimes(t *testing.T) {
 	filename := "tests/test.tar"
 
-	err := Compress(filename, "tests/input/a.txt", nil)
+	err := Compress(filename, "tests/input", nil)
 	assert.NoError(t, err)
 	defer os.Remove(filename)
 
-	header, reader, err := Find(filename, "a.txt")
-	assert.Equal(t, nil, err)
-	assert.Equal(t, "a.txt", header.Name)
-	b, _ := ioutil.ReadAll(reader)
-	assert.Equal(t, "a.txt\n", string(b))
-	assert.Equal(t, nil, reader.Close())
+	err = Extract(filename, "tests/output", &ExtractOptions{PreserveTimes: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	for _, name := range []string{"a.txt", "c", "c/c1.txt"} {
+		srcInfo, _ := os.Stat("tests/input/" + name)
+		info, _ := os.Stat("tests/output/" + name)
+		assert.WithinDuration(t, srcInfo.ModTime(), info.ModTime(), time.Second)
+	}
 }
 
-func TestFindDir(t *testing.T) {
+func TestExtractThroughSymlink(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeTar(filename, &tar.Header{Name: "c/c1.txt", Typeflag: tar.TypeReg, Mode: 0644}, "c1.txt")
+	defer os.Remove(filename)
+
+	os.MkdirAll("tests/outside", os.ModePerm)
+	defer os.RemoveAll("tests/outside")
+	os.MkdirAll("tests/output", os.ModePerm)
+	os.Symlink("../outside", "tests/output/c")
+	defer os.RemoveAll("tests/output")
+
+	err := Extract(filename, "tests/output", nil)
+	assert.Equal(t, ErrSymlinkInPath, err)
+	assert.Equal(t, false, pathExists("tests/outside/c1.txt"))
+
+	err = Extract(filename, "tests/output", &ExtractOptions{FollowSymlinks: true})
+	assert.NoError(t, err)
+	assert.Equal(t, true, pathExists("tests/outside/c1.txt"))
+}
+
+func TestExtractWithWriterFor(t *testing.T) {
 	filename := "tests/test.tar"
 
 	err := Compress(filename, "tests/input", nil)
 	assert.NoError(t, err)
 	defer os.Remove(filename)
 
-	_, reader, err := Find(filename, "c")
-	assert.Equal(t, nil, reader)
-	assert.Equal(t, nil, err)
+	buf := &bytes.Buffer{}
+	writerFor := func(header *tar.Header) (io.Writer, bool) {
+		return buf, header.Name == "a.txt"
+	}
+
+	err = Extract(filename, "tests/output", &ExtractOptions{WriterFor: writerFor})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "a.txt\n", buf.String())
+	assert.Equal(t, false, pathExists("tests/output/a.txt"))
+	assert.Equal(t, true, pathExists("tests/output/b.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c1.txt"))
 }
 
-func TestReadNotExists(t *testing.T) {
+func TestExtractWithWriterForDedupAndPerEntry(t *testing.T) {
 	filename := "tests/test.tar"
 
-	err := Compress(filename, "tests/input/a.txt", nil)
+	os.MkdirAll("tests/dedup", os.ModePerm)
+	defer os.RemoveAll("tests/dedup")
+	writeContent("tests/dedup/a.txt", "same")
+	writeContent("tests/dedup/b.txt", "same")
+
+	err := Compress(filename, "tests/dedup", &CompressOptions{Dedup: true, PerEntryCompression: true})
 	assert.NoError(t, err)
 	defer os.Remove(filename)
 
-	_, _, err = Find(filename, "notExists.txt")
-	assert.Equal(t, os.ErrNotExist, err)
+	buffers := map[string]*bytes.Buffer{}
+	writerFor := func(header *tar.Header) (io.Writer, bool) {
+		buffers[header.Name] = &bytes.Buffer{}
+		return buffers[header.Name], true
+	}
+
+	err = Extract(filename, "tests/output", &ExtractOptions{WriterFor: writerFor})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "same", buffers["a.txt"].String())
+	assert.Equal(t, "same", buffers["b.txt"].String())
 }
 
-func TestExtract(t *testing.T) {
+func TestExtractWithLastWins(t *testing.T) {
+	filename := "tests/test.tar"
+
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, Body: strings.NewReader("first")},
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, Body: strings.NewReader("last")},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{NoOverride: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "first", readContent("tests/output/a.txt"))
+	os.RemoveAll("tests/output")
+
+	err = Extract(filename, "tests/output", &ExtractOptions{NoOverride: true, LastWins: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+	assert.Equal(t, "last", readContent("tests/output/a.txt"))
+}
+
+func TestExtractWithTypeFilter(t *testing.T) {
 	filename := "tests/test.tar"
 
 	err := Compress(filename, "tests/input", nil)
 	assert.NoError(t, err)
 	defer os.Remove(filename)
 
-	err = Extract(filename, "tests/output", nil)
+	err = Extract(filename, "tests/output", &ExtractOptions{TypeFilter: []byte{tar.TypeReg}})
 	assert.NoError(t, err)
 	defer os.RemoveAll("tests/output")
 
 	assert.Equal(t, true, pathExists("tests/output/a.txt"))
-	assert.Equal(t, true, pathExists("tests/output/b.txt"))
-	assert.Equal(t, true, pathExists("tests/output/symlink.txt"))
-	assert.Equal(t, true, pathExists("tests/output/c"))
 	assert.Equal(t, true, pathExists("tests/output/c/c1.txt"))
-	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+	assert.Equal(t, false, pathExists("tests/output/symlink.txt"))
 }
 
-func TestExtractWithFlatDir(t *testing.T) {
+func TestExtractWithTextConvert(t *testing.T) {
+	filename := "tests/test.tar"
+
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 8}, Body: strings.NewReader("a\r\nb\nc\r\n")},
+		{Header: &tar.Header{Name: "b.bin", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, Body: strings.NewReader("\x00\r\n\r\n")},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{TextConvert: TextConvertToLF})
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\nc\n", readContent("tests/output/a.txt"))
+	assert.Equal(t, "\x00\r\n\r\n", readContent("tests/output/b.bin"))
+	os.RemoveAll("tests/output")
+
+	err = Extract(filename, "tests/output", &ExtractOptions{TextConvert: TextConvertToCRLF})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+	assert.Equal(t, "a\r\nb\r\nc\r\n", readContent("tests/output/a.txt"))
+}
+
+func TestExtractWithTextConvertLateNul(t *testing.T) {
+	filename := "tests/test.tar"
+
+	// The NUL byte is past the default buffer size of bufio
+	content := strings.Repeat("a\r\n", 1500) + "\x00"
+	writeTar(filename, &tar.Header{Name: "a.bin", Typeflag: tar.TypeReg, Mode: 0644}, content)
+	defer os.Remove(filename)
+
+	err := Extract(filename, "tests/output", &ExtractOptions{TextConvert: TextConvertToLF})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, content, readContent("tests/output/a.bin"))
+}
+
+func TestExtractToTemp(t *testing.T) {
 	filename := "tests/test.tar"
 
 	err := Compress(filename, "tests/input", nil)
 	assert.NoError(t, err)
 	defer os.Remove(filename)
 
-	err = Extract(filename, "tests/output", &ExtractOptions{FlatDir: true})
+	dir, cleanup, err := ExtractToTemp(filename, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "a.txt\n", readContent(filepath.Join(dir, "a.txt")))
+
+	assert.NoError(t, cleanup())
+	assert.Equal(t, false, pathExists(dir))
+
+	_, _, err = ExtractToTemp(filename, &ExtractOptions{MaxTotalSize: 10})
+	assert.Equal(t, ErrSizeLimitExceeded, err)
+}
+
+func TestExtractWithMaxTotalSizeCompressedEntry(t *testing.T) {
+	filename := "tests/test.tar"
+
+	// The compressed body is far smaller than the limit
+	os.MkdirAll("tests/zeros", os.ModePerm)
+	defer os.RemoveAll("tests/zeros")
+	ioutil.WriteFile("tests/zeros/zeros.bin", make([]byte, 2<<20), 0644)
+
+	err := Compress(filename, "tests/zeros", &CompressOptions{PerEntryCompression: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	header, err := Stat(filename, "zeros.bin")
+	assert.NoError(t, err)
+	assert.True(t, header.Size < 1<<20)
+
+	for _, concurrency := range []int{0, 4} {
+		err = Extract(filename, "tests/output", &ExtractOptions{MaxTotalSize: 1 << 20, Concurrency: concurrency})
+		assert.Equal(t, ErrSizeLimitExceeded, err)
+		os.RemoveAll("tests/output")
+	}
+
+	err = Extract(filename, "tests/output", &ExtractOptions{MaxTotalSize: 2 << 20})
 	assert.NoError(t, err)
 	defer os.RemoveAll("tests/output")
+}
+
+func TestExtractPathTraversal(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeTar(filename, &tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644}, "escape.txt")
+	defer os.Remove(filename)
+
+	err := Extract(filename, "tests/output", nil)
+	assert.Equal(t, ErrPathTraversal, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/escape.txt"))
+}
+
+func TestExtractGlobPathTraversal(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeTar(filename, &tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644}, "escape.txt")
+	defer os.Remove(filename)
+
+	_, err := ExtractGlob(filename, "tests/output", "**")
+	assert.Equal(t, ErrPathTraversal, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/escape.txt"))
+}
+
+func TestExtractThroughPlantedSymlink(t *testing.T) {
+	filename := "tests/test.tar"
+
+	// A symlink extracted first redirects the file written after it
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+		{Header: &tar.Header{Name: "c/c1.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 6}, Body: strings.NewReader("c1.txt")},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	os.MkdirAll("tests/outside", os.ModePerm)
+	defer os.RemoveAll("tests/outside")
+
+	err = Extract(filename, "tests/output", nil)
+	assert.Equal(t, ErrSymlinkInPath, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/outside/c1.txt"))
+}
+
+func TestExtractWithProgress(t *testing.T) {
+	for _, compression := range []Compression{Uncompressed, Gzip} {
+		filename := "tests/test.tar"
+
+		err := Compress(filename, "tests/input", &CompressOptions{Compression: compression})
+		assert.NoError(t, err)
+
+		info, _ := os.Stat(filename)
 
+		var lastRead, lastTotal int64
+		progress := func(read, total int64) {
+			assert.True(t, read >= lastRead)
+			lastRead, lastTotal = read, total
+		}
+
+		err = Extract(filename, "tests/output", &ExtractOptions{Progress: progress})
+		assert.NoError(t, err)
+		assert.Equal(t, info.Size(), lastTotal)
+		assert.Equal(t, info.Size(), lastRead)
+
+		os.RemoveAll("tests/output")
+		os.Remove(filename)
+	}
+}
+
+func TestExtractWithStripTopLevel(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", &CompressOptions{IncludeSourceDir: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{StripTopLevel: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, false, pathExists("tests/output/input"))
 	assert.Equal(t, true, pathExists("tests/output/a.txt"))
-	assert.Equal(t, true, pathExists("tests/output/b.txt"))
-	assert.Equal(t, true, pathExists("tests/output/symlink.txt"))
-	assert.Equal(t, false, pathExists("tests/output/c"))
-	assert.Equal(t, true, pathExists("tests/output/c1.txt"))
-	assert.Equal(t, true, pathExists("tests/output/c2.txt"))
+	assert.Equal(t, true, pathExists("tests/output/c/c1.txt"))
+
+	err = Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+
+	err = Extract(filename, "tests/output2", &ExtractOptions{StripTopLevel: true})
+	assert.Equal(t, ErrNoTopLevelDir, err)
+	assert.Equal(t, false, pathExists("tests/output2"))
 }
 
-func TestExtractWithFilters(t *testing.T) {
+func TestExtractWithStripTopLevelDotEntry(t *testing.T) {
+	filename := "tests/test.tar"
+
+	file, _ := os.Create(filename)
+	writer := tar.NewWriter(file)
+	writer.WriteHeader(&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755})
+	writer.WriteHeader(&tar.Header{Name: "./proj/", Typeflag: tar.TypeDir, Mode: 0755})
+	writer.WriteHeader(&tar.Header{Name: "./proj/a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	writer.Write([]byte("a.txt"))
+	writer.Close()
+	file.Close()
+	defer os.Remove(filename)
+
+	err := Extract(filename, "tests/output", &ExtractOptions{StripTopLevel: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "a.txt", readContent("tests/output/a.txt"))
+}
+
+func TestExtractAtomic(t *testing.T) {
 	filename := "tests/test.tar"
 
 	err := Compress(filename, "tests/input", nil)
 	assert.NoError(t, err)
 	defer os.Remove(filename)
 
-	filters := []string{"a.txt", "c/c2.txt"}
-	err = Extract(filename, "tests/output", &ExtractOptions{Filters: filters})
-	assert.NoError(t, err)
+	os.MkdirAll("tests/output", os.ModePerm)
+	writeContent("tests/output/old.txt", "old.txt")
 	defer os.RemoveAll("tests/output")
 
+	err = ExtractAtomic(filename, "tests/output", nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, false, pathExists("tests/output/old.txt"))
 	assert.Equal(t, true, pathExists("tests/output/a.txt"))
-	assert.Equal(t, false, pathExists("tests/output/b.txt"))
-	assert.Equal(t, false, pathExists("tests/output/symlink.txt"))
-	assert.Equal(t, true, pathExists("tests/output/c"))
-	assert.Equal(t, false, pathExists("tests/output/c/c1.txt"))
 	assert.Equal(t, true, pathExists("tests/output/c/c2.txt"))
+
+	tempDirs, _ := filepath.Glob("tests/.output.tmp*")
+	assert.Equal(t, 0, len(tempDirs))
+}
+
+func TestExtractAtomicWithFailure(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	// Truncates the tar file in the middle of an entry
+	assert.NoError(t, os.Truncate(filename, 2048+100))
+
+	os.MkdirAll("tests/output", os.ModePerm)
+	writeContent("tests/output/old.txt", "old.txt")
+	defer os.RemoveAll("tests/output")
+
+	err = ExtractAtomic(filename, "tests/output", nil)
+	assert.Error(t, err)
+
+	assert.Equal(t, "old.txt", readContent("tests/output/old.txt"))
+	assert.Equal(t, false, pathExists("tests/output/a.txt"))
+
+	tempDirs, _ := filepath.Glob("tests/.output.tmp*")
+	assert.Equal(t, 0, len(tempDirs))
 }
 
 func TestExtractWithOverride(t *testing.T) {
@@ -231,6 +3049,97 @@ func TestExtractWithoutOverride(t *testing.T) {
 	assert.Equal(t, "new a.txt", readContent("tests/output/a.txt"))
 }
 
+func BenchmarkExtractGzipReadBufferSize(b *testing.B) {
+	filename := "tests/bench.tar.gz"
+
+	os.MkdirAll("tests/bench", os.ModePerm)
+	defer os.RemoveAll("tests/bench")
+
+	content := make([]byte, 16<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+	ioutil.WriteFile("tests/bench/large.bin", content, os.ModePerm)
+
+	if err := Compress(filename, "tests/bench", &CompressOptions{Compression: Gzip}); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(filename)
+	defer os.RemoveAll("tests/output")
+
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := Extract(filename, "tests/output", &ExtractOptions{ReadBufferSize: size}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompressAdaptiveCompression(b *testing.B) {
+	os.MkdirAll("tests/mixed", os.ModePerm)
+	defer os.RemoveAll("tests/mixed")
+	writeMixedCorpus("tests/mixed", 4, 4<<20)
+	defer os.Remove("tests/bench.tar.gz")
+
+	for _, adaptive := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Adaptive=%v", adaptive), func(b *testing.B) {
+			options := &CompressOptions{Compression: Gzip, AdaptiveCompression: adaptive}
+			for i := 0; i < b.N; i++ {
+				if err := Compress("tests/bench.tar.gz", "tests/mixed", options); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func writeMixedCorpus(dir string, count, size int) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < count; i++ {
+		content := make([]byte, size)
+		random.Read(content)
+		ioutil.WriteFile(fmt.Sprintf("%s/%d.bin", dir, i), content, os.ModePerm)
+
+		text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), size/44)
+		ioutil.WriteFile(fmt.Sprintf("%s/%d.txt", dir, i), text, os.ModePerm)
+	}
+}
+
+// failingReader reads a few bytes and then fails
+type failingReader struct {
+	io.Reader
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+type blockingReader struct {
+	unblock chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.unblock
+	return 0, io.EOF
+}
+
+func TestToLongPath(t *testing.T) {
+	// Extraction on Windows prefixes the absolute path of each entry
+	deepDir := strings.Repeat(`directory\`, 30)
+
+	assert.Equal(t, `C:\output\a.txt`, toLongPath(`C:\output\a.txt`))
+	assert.Equal(t, `\\?\C:\output\`+deepDir+`a.txt`, toLongPath(`C:\output\`+deepDir+`a.txt`))
+	assert.Equal(t, `\\?\C:\output\`+deepDir+`a.txt`, toLongPath(`C:/output/`+deepDir+`a.txt`))
+	assert.Equal(t, `\\?\UNC\server\share\`+deepDir+`a.txt`, toLongPath(`\\server\share\`+deepDir+`a.txt`))
+	assert.Equal(t, `\\?\C:\`+deepDir, toLongPath(`\\?\C:\`+deepDir))
+}
+
 func pathExists(name string) bool {
 	if _, err := os.Stat(name); err != nil {
 		return false
@@ -238,6 +3147,35 @@ func pathExists(name string) bool {
 	return true
 }
 
+func writeSymlinkTree(dir string) {
+	os.MkdirAll(dir+"/d", os.ModePerm)
+	writeContent(dir+"/d/x.txt", "x.txt")
+	os.Symlink("..", dir+"/d/loop")
+	os.Symlink("d/x.txt", dir+"/file.lnk")
+	os.Symlink("d", dir+"/link")
+}
+
+func writeTar(filePath string, header *tar.Header, content string) {
+	file, _ := os.Create(filePath)
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	defer writer.Close()
+	header.Size = int64(len(content))
+	writer.WriteHeader(header)
+	writer.Write([]byte(content))
+}
+
+func writeManifest(filePath, dir string, names ...string) {
+	manifest := Manifest{Files: map[string]ManifestEntry{}}
+	for _, name := range names {
+		content, _ := ioutil.ReadFile(dir + "/" + name)
+		sum := sha256.Sum256(content)
+		manifest.Files[name] = ManifestEntry{Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])}
+	}
+	content, _ := json.Marshal(manifest)
+	ioutil.WriteFile(filePath, content, os.ModePerm)
+}
+
 func readContent(filePath string) string {
 	file, _ := os.OpenFile(filePath, os.O_RDWR, os.ModePerm)
 	defer file.Close()
@@ -0,0 +1,182 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package tarx
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractSparse(t *testing.T) {
+	err := Extract("tests/sparse.tar", "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	info, err := os.Stat("tests/output/sparse.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4<<20), info.Size())
+
+	content := readContent("tests/output/sparse.bin")
+	assert.Equal(t, "hello", content[1000000:1000005])
+	assert.Equal(t, "end", content[4000000:4000003])
+
+	// Blocks are always counted in 512-byte units
+	stat := info.Sys().(*syscall.Stat_t)
+	assert.True(t, stat.Blocks*512 < info.Size())
+}
+
+func TestExtractWithDefaultFileMode(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeTar(filename, &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg}, "a.txt")
+	defer os.Remove(filename)
+
+	err := Extract(filename, "tests/output", &ExtractOptions{DefaultFileMode: 0640, DefaultDirMode: 0750})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	info, err := os.Stat("tests/output/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+}
+
+func TestExtractWithReadOnly(t *testing.T) {
+	filename := "tests/test.tar"
+
+	err := Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", &ExtractOptions{ReadOnly: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	for _, name := range []string{"a.txt", "b.txt", "c/c1.txt", "c/c2.txt"} {
+		info, err := os.Stat("tests/output/" + name)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0), info.Mode().Perm()&0222)
+	}
+
+	// Directories are kept writable
+	info, err := os.Stat("tests/output/c")
+	assert.NoError(t, err)
+	assert.NotEqual(t, os.FileMode(0), info.Mode().Perm()&0200)
+}
+
+func TestExtractWithPreserveOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of files requires root")
+	}
+
+	filename := "tests/test.tar"
+
+	writeTar(filename, &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1234, Gid: 1234}, "a.txt")
+	defer os.Remove(filename)
+
+	options := &ExtractOptions{
+		PreserveOwner: true,
+		UIDMap:        map[int]int{1234: 4321},
+	}
+	err := Extract(filename, "tests/output", options)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	info, err := os.Stat("tests/output/a.txt")
+	assert.NoError(t, err)
+	stat := info.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(4321), stat.Uid)
+	assert.Equal(t, uint32(1234), stat.Gid)
+}
+
+func TestCompressWithSync(t *testing.T) {
+	filename := "tests/test.tar"
+
+	synced := []string{}
+	defer func(f func(*os.File) error) { syncFile = f }(syncFile)
+	syncFile = func(file *os.File) error {
+		synced = append(synced, file.Name())
+		return file.Sync()
+	}
+
+	err := Compress(filename, "tests/input", &CompressOptions{Sync: true})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	assert.Equal(t, []string{filename, "tests"}, synced)
+
+	synced = synced[:0]
+	err = Compress(filename, "tests/input", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, synced)
+}
+
+func TestCompressWithPAXTimes(t *testing.T) {
+	filename := "tests/test.tar"
+
+	os.MkdirAll("tests/times", os.ModePerm)
+	defer os.RemoveAll("tests/times")
+	writeContent("tests/times/a.txt", "a.txt")
+
+	mtime := time.Date(2015, 12, 5, 10, 0, 0, 123456789, time.UTC)
+	atime := time.Date(2016, 1, 2, 3, 4, 5, 987654321, time.UTC)
+	os.Chtimes("tests/times/a.txt", atime, mtime)
+
+	err := Compress(filename, "tests/times", &CompressOptions{Format: tar.FormatPAX})
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	records, err := PAXRecords(filename, "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "1449309600.123456789", records["mtime"])
+	assert.Equal(t, "1451703845.987654321", records["atime"])
+	assert.NotEmpty(t, records["ctime"])
+
+	err = Extract(filename, "tests/output", &ExtractOptions{PreserveAccessTime: true})
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	info, err := os.Stat("tests/output/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, mtime, info.ModTime().UTC())
+
+	// By default mtimes are rounded to seconds
+	err = Compress(filename, "tests/times", nil)
+	assert.NoError(t, err)
+
+	header, err := Stat(filename, "a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, mtime.Truncate(time.Second), header.ModTime.UTC())
+	assert.Equal(t, true, header.AccessTime.IsZero())
+}
+
+func TestExtractDedupReplacedBySymlink(t *testing.T) {
+	filename := "tests/test.tar"
+
+	writeContent("tests/secret.txt", "secret")
+	defer os.Remove("tests/secret.txt")
+	secret, _ := filepath.Abs("tests/secret.txt")
+
+	// a.txt is replaced by a symlink before b.txt is copied from it
+	entries := []EntrySpec{
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}, Body: strings.NewReader("same")},
+		{Header: &tar.Header{Name: "a.txt", Typeflag: tar.TypeSymlink, Linkname: secret}},
+		{Header: &tar.Header{Name: "b.txt", Typeflag: tar.TypeReg, Mode: 0644, PAXRecords: map[string]string{"TARX.dedup": "a.txt"}}},
+	}
+	err := WriteEntries(filename, entries, nil)
+	assert.NoError(t, err)
+	defer os.Remove(filename)
+
+	err = Extract(filename, "tests/output", nil)
+	assert.NoError(t, err)
+	defer os.RemoveAll("tests/output")
+
+	assert.Equal(t, "same", readContent("tests/output/b.txt"))
+}
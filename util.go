@@ -1,9 +1,29 @@
 package tarx
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type readCloserWrapper struct {
@@ -19,7 +39,996 @@ func (rc *readCloserWrapper) Close() error {
 	return nil
 }
 
+// sectionReadCloser reads a section of a file and closes the file
+type sectionReadCloser struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r *sectionReadCloser) Close() error {
+	return r.file.Close()
+}
+
+// gzipEntryReader decompresses the body of an entry written with
+// PerEntryCompression and closes the underlying reader.
+type gzipEntryReader struct {
+	*gzip.Reader
+	closer io.Closer
+}
+
+func newGzipEntryReader(r io.ReadCloser) (io.ReadCloser, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &gzipEntryReader{Reader: gzipReader, closer: r}, nil
+}
+
+func (r *gzipEntryReader) Close() error {
+	r.Reader.Close()
+	return r.closer.Close()
+}
+
+// symlinkCopy is a symlink to be extracted as a copy of its target
+type symlinkCopy struct {
+	fileName string
+	linkname string
+}
+
+// copySymlinks writes the copies of the symlinks of a tar file, `files` are
+// the regular files extracted on disk by their name in the tar file.
+// Symlinks pointing to other symlinks are followed.
+func copySymlinks(links map[string]symlinkCopy, files map[string]string, noOverride bool) error {
+	for name, link := range links {
+		target := name
+		source, ok := "", false
+
+		// Up to 40 symlinks are followed, like Linux does
+		for i := 0; i < 40 && !ok; i++ {
+			current, isLink := links[target]
+			if !isLink {
+				break
+			}
+			if path.IsAbs(current.linkname) {
+				target = path.Clean(strings.TrimLeft(current.linkname, "/"))
+			} else {
+				target = path.Join(path.Dir(target), current.linkname)
+			}
+			source, ok = files[target]
+		}
+
+		if !ok {
+			return fmt.Errorf("Symlink %s points to %s which is not a regular file extracted", name, link.linkname)
+		}
+
+		if _, err := os.Lstat(link.fileName); err == nil {
+			if noOverride {
+				continue
+			}
+			if err := os.Remove(link.fileName); err != nil {
+				return err
+			}
+		}
+
+		if err := copyFile(source, link.fileName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies a regular file with its permissions
+func copyFile(srcName, fileName string) error {
+	src, err := os.Open(srcName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+		return err
+	}
+
+	return createFile(fileName, info.Mode().Perm(), src)
+}
+
+// gitignoreRule is a pattern of a .gitignore file
+type gitignoreRule struct {
+	// dir is the directory of the .gitignore file relative to the walk root
+	dir     string
+	pattern []string
+	negate  bool
+	dirOnly bool
+}
+
+// gitignore is a minimal .gitignore matcher, the .gitignore files are
+// loaded as their directories are walked.
+type gitignore struct {
+	rules []gitignoreRule
+}
+
+// walk returns true for the files to be left out, along with
+// filepath.SkipDir for directories, and loads the .gitignore file
+// of each directory walked.
+func (g *gitignore) walk(root, filePath string, info os.FileInfo) (bool, error) {
+	rel, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return false, err
+	}
+
+	rel = filepath.ToSlash(rel)
+
+	if rel != "." && ((info.IsDir() && info.Name() == ".git") || g.ignored(rel, info.IsDir())) {
+		if info.IsDir() {
+			return true, filepath.SkipDir
+		}
+		return true, nil
+	}
+
+	if !info.IsDir() {
+		return false, nil
+	}
+
+	if rel == "." {
+		rel = ""
+	}
+
+	return false, g.load(filepath.Join(filePath, ".gitignore"), rel)
+}
+
+// load reads the rules of a .gitignore file, if it exists
+func (g *gitignore) load(fileName, dir string) error {
+	content, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := gitignoreRule{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		// Patterns without a slash match at any depth
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+
+		rule.pattern = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		g.rules = append(g.rules, rule)
+	}
+
+	return nil
+}
+
+// ignored returns true if the last rule matching a path ignores it
+func (g *gitignore) ignored(rel string, isDir bool) bool {
+	ignored := false
+
+	for _, rule := range g.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		name := rel
+		if rule.dir != "" {
+			if !strings.HasPrefix(rel, rule.dir+"/") {
+				continue
+			}
+			name = rel[len(rule.dir)+1:]
+		}
+
+		if matched, _ := globMatches(rule.pattern, strings.Split(name, "/")); matched {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
+
+// walkFollow walks a file tree like filepath.Walk but following symlinks,
+// a directory is not walked again inside itself to avoid cycles.
+func walkFollow(root string, fn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+
+	err = walkFollowPath(root, info, map[string]bool{}, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkFollowPath walks `filePath`, `visited` holds the real paths of the
+// directories being walked.
+func walkFollowPath(filePath string, info os.FileInfo, visited map[string]bool, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(filePath, info, nil)
+	}
+
+	realPath, err := filepath.EvalSymlinks(filePath)
+	if err != nil {
+		return fn(filePath, info, err)
+	}
+
+	// The directory itself is still reported, just not walked again
+	if visited[realPath] {
+		return fn(filePath, info, nil)
+	}
+	visited[realPath] = true
+	defer delete(visited, realPath)
+
+	if err := fn(filePath, info, nil); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(filePath)
+	if err != nil {
+		return fn(filePath, info, err)
+	}
+
+	for _, info := range infos {
+		childPath := filepath.Join(filePath, info.Name())
+
+		// Broken symlinks are reported as symlinks
+		if info.Mode()&os.ModeSymlink != 0 {
+			if targetInfo, err := os.Stat(childPath); err == nil {
+				info = targetInfo
+			}
+		}
+
+		if err := walkFollowPath(childPath, info, visited, fn); err != nil {
+			if err == filepath.SkipDir && info.IsDir() {
+				continue
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findArchiveEnd returns the offset right after the last entry of an
+// uncompressed tar file, where the end-of-archive marker starts.
+// If `truncated` is true the tar file may end in the middle of an entry,
+// like when the process writing it was killed, and that entry is dropped.
+// A last checksum entry is dropped too as it would not cover new entries.
+func findArchiveEnd(file *os.File, truncated bool) (int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	// The counter must not be an io.Seeker, otherwise tar.Reader
+	// skips the bodies without us knowing
+	counter := &countingReader{Reader: file}
+	reader := tar.NewReader(counter)
+
+	end := int64(0)
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && truncated) {
+			return end, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			if err == io.ErrUnexpectedEOF && truncated {
+				return end, nil
+			}
+			return 0, err
+		}
+
+		// The checksum is always the last entry
+		if header.Name == ChecksumEntryName {
+			return end, nil
+		}
+
+		// Bodies are padded to blocks of 512 bytes
+		end = (counter.Count + 511) &^ 511
+	}
+}
+
+// hashBodies returns the SHA-256 of the bodies of the entries of an
+// uncompressed tar file up to `end`, so the checksum of a tar file
+// appended to covers the entries already in it.
+func hashBodies(file *os.File, end int64) (hash.Hash, error) {
+	checksum := sha256.New()
+	reader := tar.NewReader(io.NewSectionReader(file, 0, end))
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return checksum, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Name == ChecksumEntryName {
+			continue
+		}
+
+		if _, err := io.Copy(checksum, reader); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// checkpoint records the names of the entries written into a tar file,
+// one quoted name per line.
+type checkpoint struct {
+	file *os.File
+	done map[string]bool
+}
+
+// openCheckpoint reads the entries recorded in a checkpoint file,
+// the file is created if it does not exist.
+func openCheckpoint(fileName string) (*checkpoint, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	done := map[string]bool{}
+	for _, line := range strings.Split(string(content), "\n") {
+		// A line may be incomplete if the process was killed
+		if name, err := strconv.Unquote(line); err == nil {
+			done[name] = true
+		}
+	}
+
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &checkpoint{file: file, done: done}, nil
+}
+
+// add records an entry, it does nothing on a nil checkpoint.
+func (c *checkpoint) add(name string) error {
+	if c == nil {
+		return nil
+	}
+	_, err := c.file.WriteString(strconv.Quote(name) + "\n")
+	return err
+}
+
+// Close closes the checkpoint file
+func (c *checkpoint) Close() error {
+	return c.file.Close()
+}
+
+// Remove closes and removes the checkpoint file
+func (c *checkpoint) Remove() error {
+	c.file.Close()
+	return os.Remove(c.file.Name())
+}
+
+// volumeWriter writes a tar file into volumes of at most `maxBytes`
+// bytes named like Split does, a volume is created once it is written.
+type volumeWriter struct {
+	fileName string
+	maxBytes int64
+	sync     bool
+	file     *os.File
+	written  int64
+	names    []string
+}
+
+func (w *volumeWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if w.file == nil || w.written == w.maxBytes {
+			if err := w.next(); err != nil {
+				return n, err
+			}
+		}
+
+		chunk := p
+		if left := w.maxBytes - w.written; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+
+		m, err := w.file.Write(chunk)
+		n += m
+		w.written += int64(m)
+		p = p[m:]
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// reserve starts a new volume unless the current one is empty
+// or has room for `size` more bytes.
+func (w *volumeWriter) reserve(size int64) error {
+	if w.file == nil || w.written == 0 || w.written+size <= w.maxBytes {
+		return nil
+	}
+	return w.next()
+}
+
+// next closes the current volume and creates the next one
+func (w *volumeWriter) next() error {
+	if err := w.closeFile(); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s.%03d", w.fileName, len(w.names)+1)
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	w.file = file
+	w.written = 0
+	w.names = append(w.names, name)
+
+	return nil
+}
+
+// closeFile closes the current volume, if any
+func (w *volumeWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+
+	file := w.file
+	w.file = nil
+
+	var err error
+	if w.sync {
+		err = syncFile(file)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Close closes the current volume, all volumes are removed if `remove` is true
+func (w *volumeWriter) Close(remove bool) error {
+	if remove {
+		w.sync = false
+	}
+
+	err := w.closeFile()
+
+	if remove {
+		for _, name := range w.names {
+			os.Remove(name)
+		}
+		return err
+	}
+
+	// The directory entries of the volumes are flushed as well
+	if w.sync && err == nil && len(w.names) > 0 {
+		err = syncDir(filepath.Dir(w.fileName))
+	}
+
+	return err
+}
+
+// sizeLimit bounds the bytes read from all readers it returns,
+// which may be read concurrently.
+type sizeLimit struct {
+	max   int64
+	total int64
+}
+
+// reader returns `r` counting its bytes, or `r` itself on a nil sizeLimit.
+func (l *sizeLimit) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{Reader: r, limit: l}
+}
+
+// limitedReader fails with ErrSizeLimitExceeded once its sizeLimit is exceeded
+type limitedReader struct {
+	io.Reader
+	limit *sizeLimit
+}
+
+func (r *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if atomic.AddInt64(&r.limit.total, int64(n)) > r.limit.max {
+		return n, ErrSizeLimitExceeded
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	Reader io.Reader
+	Count  int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.Count += int64(n)
+	return n, err
+}
+
+// textReader converts the line endings of a text stream
+type textReader struct {
+	reader  *bufio.Reader
+	convert TextConvert
+	last    byte
+	pending []byte
+}
+
+// newTextReader returns a reader converting the line endings of `r`,
+// unless its first bytes contain a NUL byte.
+func newTextReader(r io.Reader, convert TextConvert) io.Reader {
+	// The default buffer only holds 4096 bytes to peek at
+	reader := bufio.NewReaderSize(r, textSampleSize)
+
+	if sample, _ := reader.Peek(textSampleSize); bytes.IndexByte(sample, 0) >= 0 {
+		return reader
+	}
+
+	return &textReader{reader: reader, convert: convert}
+}
+
+func (r *textReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(r.pending) > 0 {
+			p[n] = r.pending[0]
+			r.pending = r.pending[1:]
+			n++
+			continue
+		}
+
+		b, err := r.reader.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		switch {
+		case r.convert == TextConvertToLF && b == '\r':
+			if next, _ := r.reader.Peek(1); len(next) == 1 && next[0] == '\n' {
+				continue
+			}
+		case r.convert == TextConvertToCRLF && b == '\n' && r.last != '\r':
+			r.pending = append(r.pending, '\r')
+		}
+
+		r.pending = append(r.pending, b)
+		r.last = b
+	}
+
+	return n, nil
+}
+
+// progressReader reports the bytes read from the underlying reader
+type progressReader struct {
+	Reader   io.Reader
+	Total    int64
+	Progress func(read, total int64)
+	read     int64
+}
+
+func (r *progressReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		r.Progress(r.read, r.Total)
+	}
+	return n, err
+}
+
+// workerPool runs jobs in a fixed number of goroutines, once a job
+// fails the jobs left are dropped.
+type workerPool struct {
+	jobs chan func() error
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	err  error
+}
+
+func newWorkerPool(workers int) *workerPool {
+	p := &workerPool{jobs: make(chan func() error, workers)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for job := range p.jobs {
+		if p.firstError() == nil {
+			if err := job(); err != nil {
+				p.mu.Lock()
+				if p.err == nil {
+					p.err = err
+				}
+				p.mu.Unlock()
+			}
+		}
+		p.wg.Done()
+	}
+}
+
+// submit queues a job, it blocks while all workers are busy
+func (p *workerPool) submit(job func() error) {
+	p.wg.Add(1)
+	p.jobs <- job
+}
+
+// wait waits for the jobs queued and returns the first error
+func (p *workerPool) wait() error {
+	p.wg.Wait()
+	return p.firstError()
+}
+
+// firstError returns the first error of the jobs done so far
+func (p *workerPool) firstError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// close waits for the jobs queued and stops the workers
+func (p *workerPool) close() {
+	p.wg.Wait()
+	close(p.jobs)
+}
+
+// retryReader reads a file to be written into a tar file, opening it
+// again and skipping the bytes read so far when reading fails, as long
+// as retry returns true.
+type retryReader struct {
+	io.ReadCloser
+	fileName string
+	retry    func(fileName string, attempt int, err error) bool
+	attempt  int
+	read     int64
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.ReadCloser.Read(p)
+		r.read += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		// Opening the file again may fail as well
+		for err != nil {
+			r.attempt++
+			if !r.retry(r.fileName, r.attempt, err) {
+				return n, err
+			}
+			err = r.reopen()
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// reopen opens the file again positioned where the last read ended
+func (r *retryReader) reopen() error {
+	r.ReadCloser.Close()
+
+	file, err := openFile(r.fileName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, file, r.read); err != nil {
+		file.Close()
+		return err
+	}
+
+	r.ReadCloser = file
+	return nil
+}
+
+// contextReader stops reading as soon as the context is done,
+// even if the underlying reader is blocked.
+type contextReader struct {
+	ctx    context.Context
+	Reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (n int, err error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	// The read happens in its own buffer because it may complete
+	// after we have given up on it
+	buf := make([]byte, len(p))
+	done := make(chan result, 1)
+
+	go func() {
+		n, err := r.Reader.Read(buf)
+		done <- result{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
+
+// writerProxy forwards the writes to a writer that can be replaced
+type writerProxy struct {
+	Writer io.Writer
+}
+
+func (w *writerProxy) Write(p []byte) (n int, err error) {
+	return w.Writer.Write(p)
+}
+
+// entropy returns the Shannon entropy of `p` in bits per byte
+func entropy(p []byte) float64 {
+	if len(p) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range p {
+		counts[b]++
+	}
+
+	e := 0.0
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		f := float64(count) / float64(len(p))
+		e -= f * math.Log2(f)
+	}
+
+	return e
+}
+
+// setTimes sets the mtime of a file from a tar header, the atime is
+// the one from the header if `accessTime` is true and the header has one,
+// otherwise the mtime.
+func setTimes(fileName string, header *tar.Header, accessTime bool) error {
+	return os.Chtimes(fileName, accessTimeOf(header, accessTime), header.ModTime)
+}
+
+// accessTimeOf returns the atime to be set from a tar header, see setTimes.
+func accessTimeOf(header *tar.Header, accessTime bool) time.Time {
+	if accessTime && !header.AccessTime.IsZero() {
+		return header.AccessTime
+	}
+	return header.ModTime
+}
+
+// formatOf detects the container format from the first block of a file
+func formatOf(block []byte) Format {
+	switch compressionOf(block) {
+	case Gzip:
+		return FormatTarGzip
+	case Bzip2:
+		return FormatTarBzip2
+	}
+
+	// Local file header, or end of central directory for empty zip files
+	if bytes.HasPrefix(block, []byte("PK\x03\x04")) || bytes.HasPrefix(block, []byte("PK\x05\x06")) {
+		return FormatZip
+	}
+
+	if len(block) == 512 && validTarChecksum(block) {
+		return FormatTar
+	}
+
+	return FormatUnknown
+}
+
+// validTarChecksum checks the checksum of a tar header block, it is
+// the sum of all bytes with the checksum field itself as spaces.
+func validTarChecksum(block []byte) bool {
+	field := strings.Trim(string(block[148:156]), " \x00")
+	stored, err := strconv.ParseInt(field, 8, 64)
+	if err != nil {
+		return false
+	}
+
+	sum := int64(0)
+	for i, b := range block {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += int64(b)
+	}
+
+	return sum == stored
+}
+
+// errInvalidAppleDouble is returned for malformed AppleDouble files
+var errInvalidAppleDouble = errors.New("Invalid AppleDouble file")
+
+// parseAppleDouble returns the Finder info, the resource fork and the
+// extended attributes stored in an AppleDouble file as extended attributes.
+func parseAppleDouble(data []byte) (map[string][]byte, error) {
+	if len(data) < 26 || binary.BigEndian.Uint32(data) != 0x00051607 {
+		return nil, errInvalidAppleDouble
+	}
+
+	// slice returns data[offset:offset+length] or nil if out of bounds
+	slice := func(offset, length uint32) []byte {
+		if uint64(offset)+uint64(length) > uint64(len(data)) {
+			return nil
+		}
+		return data[offset : offset+length]
+	}
+
+	attrs := map[string][]byte{}
+	count := int(binary.BigEndian.Uint16(data[24:]))
+
+	for i := 0; i < count; i++ {
+		entry := slice(uint32(26+i*12), 12)
+		if entry == nil {
+			return nil, errInvalidAppleDouble
+		}
+
+		id := binary.BigEndian.Uint32(entry)
+		content := slice(binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:]))
+		if content == nil {
+			return nil, errInvalidAppleDouble
+		}
+
+		switch id {
+		case 2:
+			if len(content) > 0 {
+				attrs["com.apple.ResourceFork"] = content
+			}
+		case 9:
+			if len(content) < 32 {
+				return nil, errInvalidAppleDouble
+			}
+			if !isZero(content[:32]) {
+				attrs["com.apple.FinderInfo"] = content[:32]
+			}
+			// The extended attributes follow the Finder info and 2 bytes of padding
+			if len(content) >= 70 && string(content[34:38]) == "ATTR" {
+				if err := parseAppleDoubleAttrs(content[34:], slice, attrs); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return attrs, nil
+}
+
+// parseAppleDoubleAttrs parses the extended attributes header of an
+// AppleDouble file, the offsets of the values are relative to the file.
+func parseAppleDoubleAttrs(header []byte, slice func(offset, length uint32) []byte, attrs map[string][]byte) error {
+	count := int(binary.BigEndian.Uint16(header[34:]))
+	entries := header[36:]
+
+	for i := 0; i < count; i++ {
+		if len(entries) < 11 || len(entries) < 11+int(entries[10]) {
+			return errInvalidAppleDouble
+		}
+
+		nameLen := int(entries[10])
+		name := strings.TrimRight(string(entries[11:11+nameLen]), "\x00")
+		value := slice(binary.BigEndian.Uint32(entries), binary.BigEndian.Uint32(entries[4:]))
+		if value == nil {
+			return errInvalidAppleDouble
+		}
+		attrs[name] = value
+
+		// Entries are aligned to 4 bytes
+		size := (11 + nameLen + 3) &^ 3
+		if size > len(entries) {
+			size = len(entries)
+		}
+		entries = entries[size:]
+	}
+
+	return nil
+}
+
+// fileChecksum returns the hex SHA-256 of the content of a file,
+// tests replace it to count the files read.
+var fileChecksum = func(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// applyDefaultMode sets the default permissions of the options
+// on a header stored without any permission bits
+func applyDefaultMode(header *tar.Header, options *ExtractOptions) {
+	switch header.Typeflag {
+	case tar.TypeDir, typeGNUDumpDir:
+		header.Mode |= int64(options.DefaultDirMode.Perm())
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		header.Mode |= int64(options.DefaultFileMode.Perm())
+	}
+}
+
+// setOwner sets the uid and gid of a header on a file, remapped
+// by `uidMap` and `gidMap`.
+func setOwner(fileName string, header *tar.Header, uidMap, gidMap map[int]int) error {
+	uid, gid := header.Uid, header.Gid
+	if mapped, ok := uidMap[uid]; ok {
+		uid = mapped
+	}
+	if mapped, ok := gidMap[gid]; ok {
+		gid = mapped
+	}
+
+	if err := os.Lchown(fileName, uid, gid); err != nil {
+		return err
+	}
+
+	// Changing the owner clears the setuid and setgid bits
+	mode := header.FileInfo().Mode()
+	if mode&(os.ModeSetuid|os.ModeSetgid) != 0 && mode&os.ModeSymlink == 0 {
+		return os.Chmod(fileName, mode)
+	}
+
+	return nil
+}
+
 func createFile(filePath string, mode os.FileMode, reader io.Reader) error {
+	return createFileWith(filePath, mode, reader, nil)
+}
+
+// createFileWith creates a file like createFile, calling `prepare`
+// if not nil before the content is written.
+func createFileWith(filePath string, mode os.FileMode, reader io.Reader, prepare func(*os.File) error) error {
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, mode)
 	if err != nil {
 		return err
@@ -27,6 +1036,12 @@ func createFile(filePath string, mode os.FileMode, reader io.Reader) error {
 
 	defer file.Close()
 
+	if prepare != nil {
+		if err := prepare(file); err != nil {
+			return err
+		}
+	}
+
 	if _, err := io.Copy(file, reader); err != nil {
 		return err
 	}
@@ -34,45 +1049,419 @@ func createFile(filePath string, mode os.FileMode, reader io.Reader) error {
 	return nil
 }
 
-func prepareFilters(filters []string) [][]string {
-	if filters == nil {
-		filters = []string{}
+// dumpDir builds the GNU incremental listing of a directory, each name is
+// prefixed by 'D' for directories, 'Y' for files modified after `since`
+// and 'N' for files left out of the archive.
+func dumpDir(dirPath string, since time.Time) ([]byte, error) {
+	infos, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	for _, info := range infos {
+		switch {
+		case info.IsDir():
+			buf.WriteByte('D')
+		case info.ModTime().After(since):
+			buf.WriteByte('Y')
+		default:
+			buf.WriteByte('N')
+		}
+		buf.WriteString(info.Name())
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(0)
+
+	return buf.Bytes(), nil
+}
+
+// rewriteLink makes the target of the symlink `filePath` relative to it
+// when the target lies inside `root`, otherwise `link` is returned as is.
+func rewriteLink(filePath, link, root string) (string, error) {
+	absFilePath, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	linkDir := filepath.Dir(absFilePath)
+
+	target := link
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(linkDir, target)
+	}
+
+	if !isWithin(root, target) {
+		return link, nil
+	}
+
+	return filepath.Rel(linkDir, target)
+}
+
+// checkJail returns ErrSymlinkInPath if the nearest existing parent
+// directory of `filePath` resolves outside of `root`, which must be
+// resolved already.
+func checkJail(root, filePath string) error {
+	dir := filepath.Dir(filePath)
+
+	for {
+		_, err := os.Lstat(dir)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	resolved, err := resolvePath(dir)
+	if err != nil {
+		return err
+	}
+
+	if !isWithin(root, resolved) {
+		return ErrSymlinkInPath
+	}
+
+	return nil
+}
+
+// regularFileWithin reports whether `filePath` is a regular file, not a
+// symlink, whose parent directory resolves inside `root`.
+func regularFileWithin(root, filePath string) bool {
+	info, err := os.Lstat(filePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return checkJail(root, filePath) == nil
+}
+
+// resolvePath returns the absolute path of an existing file
+// with all symlinks resolved
+func resolvePath(filePath string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filePath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(resolved)
+}
+
+// isWithin reports whether `filePath` is `root` or lies inside it,
+// both paths are expected to be absolute.
+func isWithin(root, filePath string) bool {
+	rel, err := filepath.Rel(root, filePath)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// pathDepth returns the number of components of a relative path
+func pathDepth(name string) int {
+	name = strings.Trim(filepath.ToSlash(filepath.Clean(name)), "/")
+	if name == "" || name == "." {
+		return 0
+	}
+	return strings.Count(name, "/") + 1
+}
+
+// globMatches matches the directories of a path against the directories
+// of a glob pattern, `**` matches zero or more directories.
+func globMatches(patternDirs, pathDirs []string) (bool, error) {
+	for len(patternDirs) > 0 {
+		if patternDirs[0] == "**" {
+			for i := 0; i <= len(pathDirs); i++ {
+				matched, err := globMatches(patternDirs[1:], pathDirs[i:])
+				if err != nil || matched {
+					return matched, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(pathDirs) == 0 {
+			return false, nil
+		}
+
+		matched, err := path.Match(patternDirs[0], pathDirs[0])
+		if err != nil || !matched {
+			return false, err
+		}
+
+		patternDirs = patternDirs[1:]
+		pathDirs = pathDirs[1:]
+	}
+
+	return len(pathDirs) == 0, nil
+}
+
+// headerChanged reports whether a file on disk differs from a tar header
+// by type, size, permissions or mtime, only regular files are compared by
+// size and mtime. `size` is the size of the content of the entry.
+func headerChanged(header *tar.Header, size int64, fileInfo os.FileInfo) bool {
+	headerInfo := header.FileInfo()
+
+	if headerInfo.Mode() != fileInfo.Mode() {
+		return true
+	}
+
+	if !fileInfo.Mode().IsRegular() {
+		return false
+	}
+
+	if size != fileInfo.Size() {
+		return true
+	}
+
+	// Tar headers may only keep the mtime rounded to seconds
+	elapsed := header.ModTime.Sub(fileInfo.ModTime())
+	return elapsed >= time.Second || elapsed <= -time.Second
+}
+
+// isSparse reports whether a tar header is a GNU sparse file,
+// either in the old GNU format or in any of the PAX formats.
+func isSparse(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for _, key := range []string{"GNU.sparse.major", "GNU.sparse.map", "GNU.sparse.numblocks"} {
+		if _, ok := header.PAXRecords[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// createSparseFile creates a file skipping the blocks full of zeros,
+// so they become holes on file systems supporting sparse files.
+func createSparseFile(filePath string, mode os.FileMode, reader io.Reader, size int64) error {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	buf := make([]byte, 32*1024)
+	offset := int64(0)
+
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 && !isZero(buf[:n]) {
+			if _, err := file.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Extends the file in case it ends with a hole
+	return file.Truncate(size)
+}
+
+// isZero reports whether all bytes are zero
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// unsupportedOption returns the name of the first field of a struct of
+// options which is set and is not one of `supported`, or "" if none is.
+func unsupportedOption(options interface{}, supported ...string) string {
+	value := reflect.Indirect(reflect.ValueOf(options))
+
+	allowed := map[string]bool{}
+	for _, name := range supported {
+		allowed[name] = true
+	}
+
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		if !allowed[name] && !value.Field(i).IsZero() {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// sanitizeName replaces NUL and control characters with '_',
+// it returns false if the name had any.
+func sanitizeName(name string) (string, bool) {
+	valid := true
+
+	sanitized := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			valid = false
+			return '_'
+		}
+		return r
+	}, name)
+
+	return sanitized, valid
+}
+
+// maxShortPath is the longest Windows path that works without the
+// extended-length prefix, MAX_PATH minus room for an 8.3 file name.
+const maxShortPath = 248
+
+// toLongPath converts an absolute Windows path longer than maxShortPath
+// into an extended-length path (`\\?\`), which is not limited by MAX_PATH.
+// Extended-length paths are not normalized, so `fileName` must be clean.
+func toLongPath(fileName string) string {
+	if len(fileName) < maxShortPath {
+		return fileName
+	}
+
+	fileName = strings.Replace(fileName, "/", `\`, -1)
+
+	switch {
+	case strings.HasPrefix(fileName, `\\?\`):
+		return fileName
+	case strings.HasPrefix(fileName, `\\`):
+		return `\\?\UNC\` + fileName[2:]
+	default:
+		return `\\?\` + fileName
+	}
+}
+
+// checkSymlinks returns ErrSymlinkInPath if any parent directory of
+// `name` is a symlink on disk, `name` is relative to `targetDir`.
+func checkSymlinks(targetDir, name string) error {
+	dir := filepath.Dir(name)
+	if dir == "." {
+		return nil
+	}
+
+	parentPath := targetDir
+
+	for _, component := range strings.Split(dir, string(os.PathSeparator)) {
+		parentPath = filepath.Join(parentPath, component)
+
+		info, err := os.Lstat(parentPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return ErrSymlinkInPath
+		}
 	}
 
-	preparedFilters := make([][]string, len(filters))
+	return nil
+}
+
+// pathFilter is a filter of the Filters options split by directory,
+// filters starting with `!` exclude the paths they match.
+type pathFilter struct {
+	dirs   []string
+	negate bool
+}
+
+func prepareFilters(filters []string) []pathFilter {
+	preparedFilters := make([]pathFilter, len(filters))
 
 	for i, filter := range filters {
-		preparedFilters[i] = strings.Split(filter, string(os.PathSeparator))
+		if strings.HasPrefix(filter, "!") {
+			preparedFilters[i].negate = true
+			filter = filter[1:]
+		} else if strings.HasPrefix(filter, `\!`) {
+			// Names starting with `!` are escaped like in .gitignore files
+			filter = filter[1:]
+		}
+		preparedFilters[i].dirs = strings.Split(filter, string(os.PathSeparator))
 	}
 
 	return preparedFilters
 }
 
-func optimizedMatches(path string, filters [][]string) bool {
+// optimizedMatches returns true if the last filter matching a path is not
+// a negation. Filters match the paths under them and the directories
+// above them, so these are walked, while negations only match the paths
+// under them. Without filters other than negations all paths match
+// unless excluded.
+// The paths under a directory not matching never match either.
+func optimizedMatches(path string, filters []pathFilter) bool {
 	if len(filters) == 0 {
 		return true
 	}
 
 	pathDirs := strings.Split(path, string(os.PathSeparator))
 
+	matches := true
+	for _, filter := range filters {
+		if !filter.negate {
+			matches = false
+			break
+		}
+	}
+
 	for _, filter := range filters {
+		// The directories above an excluded path are still matched
+		if filter.negate && len(pathDirs) < len(filter.dirs) {
+			continue
+		}
+
 		i := 0
-		count := min(len(pathDirs), len(filter))
+		count := min(len(pathDirs), len(filter.dirs))
 
-		for {
-			if i == count {
-				return true
-			}
+		for i < count && pathDirs[i] == filter.dirs[i] {
+			i++
+		}
+
+		if i == count {
+			matches = !filter.negate
+		}
+	}
+
+	return matches
+}
+
+// markFilters sets `used` for the filters matching a path itself or a
+// directory above it, unlike optimizedMatches the directories above
+// a filter do not count.
+func markFilters(path string, filters []pathFilter, used []bool) {
+	pathDirs := strings.Split(path, string(os.PathSeparator))
+
+	for i, filter := range filters {
+		if used[i] || len(pathDirs) < len(filter.dirs) {
+			continue
+		}
 
-			if pathDirs[i] != filter[i] {
+		matched := true
+		for j, dir := range filter.dirs {
+			if pathDirs[j] != dir {
+				matched = false
 				break
 			}
-
-			i++
 		}
+		used[i] = matched
 	}
+}
 
-	return false
+// reportUnusedFilters calls `fn` with the filters not marked as used
+func reportUnusedFilters(filters []string, used []bool, fn func(filter string)) {
+	for i, filter := range filters {
+		if !used[i] {
+			fn(filter)
+		}
+	}
 }
 
 func min(a, b int) int {